@@ -0,0 +1,100 @@
+// Package certwatcher serves a TLS key pair from files and picks up rotated files without a restart. The webhook
+// server and the health-proxy both use it for their serving certificates.
+package certwatcher
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Watcher serves a TLS key pair and switches to a rotated key pair in place, so that a renewed certificate secret
+// takes effect without restarting the server.
+type Watcher struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	certData []byte
+	keyData  []byte
+}
+
+// New loads the key pair, and fails if it cannot be loaded. Call Run to pick up rotations.
+func New(certPath, keyPath string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{
+		certPath: certPath,
+		keyPath:  keyPath,
+		interval: interval,
+	}
+
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.cert, nil
+}
+
+// Run polls the key pair until the stop channel is closed.
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := w.reload(); err != nil {
+			klog.ErrorS(err, "Failed to reload TLS key pair, keeping the current one", "cert", w.certPath)
+		}
+	}, w.interval, stopCh)
+}
+
+func (w *Watcher) reload() error {
+	certData, err := ioutil.ReadFile(w.certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate %s: %s", w.certPath, err)
+	}
+
+	keyData, err := ioutil.ReadFile(w.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read key %s: %s", w.keyPath, err)
+	}
+
+	w.lock.RLock()
+	unchanged := bytes.Equal(certData, w.certData) && bytes.Equal(keyData, w.keyData)
+	w.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	// The secret volume may be half way through an update, in which case the pair does not match yet and the next
+	// poll picks it up.
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	cert.Leaf = leaf
+
+	w.lock.Lock()
+	w.cert = &cert
+	w.certData = certData
+	w.keyData = keyData
+	w.lock.Unlock()
+
+	klog.InfoS("Loaded TLS certificate", "commonName", leaf.Subject.CommonName, "dnsNames", leaf.DNSNames, "notAfter", leaf.NotAfter)
+	return nil
+}
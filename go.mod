@@ -4,11 +4,14 @@ go 1.15
 
 require (
 	github.com/coreos/go-iptables v0.5.0
+	github.com/go-logr/logr v0.4.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/stretchr/testify v1.7.0 // indirect
 	k8s.io/api v0.21.0
 	k8s.io/apimachinery v0.21.0
 	k8s.io/client-go v0.20.4
-	k8s.io/klog v1.0.0
+	k8s.io/klog/v2 v2.8.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace k8s.io/client-go => k8s.io/client-go v0.21.0
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout      = 3 * time.Second
+	defaultRetries      = 2
+	defaultRetryBackoff = 200 * time.Millisecond
+	// handshakeTTL is how long a successful version handshake with a health-proxy is trusted.
+	handshakeTTL = 10 * time.Minute
+)
+
+// Client calls the control API of health-proxies. Every call takes the address (host:port) of the health-proxy, since
+// each node runs its own. Before the first call to an address, the client checks that the health-proxy serves this
+// API version, so a health-proxy that is older or newer than the caller fails with a clear error.
+type Client struct {
+	// HTTPClient is used for every attempt. Its timeout bounds a single attempt.
+	HTTPClient *http.Client
+	// Retries is how often a call is retried after a transport error or a 5xx response.
+	Retries      int
+	RetryBackoff time.Duration
+	// TokenFile, if set, holds a bearer token sent with every request. It is read on every call, so rotated tokens
+	// are picked up.
+	TokenFile string
+	// CAFile, if set, makes the client call health-proxies over TLS and verify their certificate for ServerName
+	// against the CA certificates in the file. It is read on every connection, so a renewed CA is picked up. The
+	// node addresses are not in the certificates, hence the fixed ServerName.
+	CAFile     string
+	ServerName string
+
+	lock       sync.Mutex
+	handshakes map[string]time.Time
+}
+
+// NewClient returns a client with default timeouts and retries that authenticates with the token in tokenFile. With
+// a caFile it uses TLS, see Client.CAFile.
+func NewClient(tokenFile, caFile, serverName string) *Client {
+	c := &Client{
+		Retries:      defaultRetries,
+		RetryBackoff: defaultRetryBackoff,
+		TokenFile:    tokenFile,
+		CAFile:       caFile,
+		ServerName:   serverName,
+		handshakes:   map[string]time.Time{},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// The certificate is checked by verifyConnection instead, against the current content of CAFile.
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifyConnection,
+	}
+	c.HTTPClient = &http.Client{Timeout: defaultTimeout, Transport: transport}
+	return c
+}
+
+func (c *Client) verifyConnection(cs tls.ConnectionState) error {
+	data, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA: %s", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no CA certificates in %s", c.CAFile)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("health-proxy sent no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       c.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// FailService makes the health check of the service fail on the health-proxy at addr, until it is reset or the TTL
+// expires. The TTL is rounded up to whole seconds.
+func (c *Client) FailService(ctx context.Context, addr string, ref ServiceRef, ttl time.Duration) error {
+	in := &FailRequest{TTLSeconds: int64((ttl + time.Second - 1) / time.Second)}
+	return c.call(ctx, addr, http.MethodPost, ServicePath(ref, ActionFail), in, nil)
+}
+
+// ResetService restores the health check of the service on the health-proxy at addr.
+func (c *Client) ResetService(ctx context.Context, addr string, ref ServiceRef) error {
+	return c.call(ctx, addr, http.MethodPost, ServicePath(ref, ActionReset), nil, nil)
+}
+
+// ServiceStatus reads the health check state of the service from the health-proxy at addr.
+func (c *Client) ServiceStatus(ctx context.Context, addr string, ref ServiceRef) (*ServiceStatus, error) {
+	status := &ServiceStatus{}
+	if err := c.call(ctx, addr, http.MethodGet, ServicePath(ref, ""), nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Version reads the API versions served by the health-proxy at addr.
+func (c *Client) Version(ctx context.Context, addr string) (*VersionInfo, error) {
+	info := &VersionInfo{}
+	if err := c.do(ctx, addr, http.MethodGet, VersionPath, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *Client) call(ctx context.Context, addr, method, path string, in, out interface{}) error {
+	if err := c.handshake(ctx, addr); err != nil {
+		return err
+	}
+
+	err := c.do(ctx, addr, method, path, in, out)
+	if apiErr, ok := err.(*Error); ok && apiErr.Code == "" {
+		// Not a response of this API, the health-proxy was replaced since the handshake.
+		c.forget(addr)
+		return fmt.Errorf("health-proxy at %s does not serve API %s: %s", addr, Version, err)
+	}
+	return err
+}
+
+func (c *Client) handshake(ctx context.Context, addr string) error {
+	c.lock.Lock()
+	at, ok := c.handshakes[addr]
+	c.lock.Unlock()
+	if ok && time.Since(at) < handshakeTTL {
+		return nil
+	}
+
+	info, err := c.Version(ctx, addr)
+	if err != nil {
+		if apiErr, ok := err.(*Error); ok && apiErr.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("health-proxy at %s predates the versioned API, expected %s", addr, Version)
+		}
+		return fmt.Errorf("version handshake with health-proxy at %s failed: %s", addr, err)
+	}
+
+	for _, v := range info.APIVersions {
+		if v == Version {
+			c.lock.Lock()
+			c.handshakes[addr] = time.Now()
+			c.lock.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("health-proxy at %s serves API versions %v, expected %s", addr, info.APIVersions, Version)
+}
+
+func (c *Client) forget(addr string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.handshakes, addr)
+}
+
+// do sends the request, retrying transport errors and 5xx responses with exponential backoff until the retries or
+// the context run out.
+func (c *Client) do(ctx context.Context, addr, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to encode request: %s", err)
+		}
+	}
+
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(ctx, addr, method, path, body, out)
+		if err == nil || !retry || attempt >= c.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s, giving up: %s", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, addr, method, path string, body []byte, out interface{}) (bool, error) {
+	scheme := "http://"
+	if c.CAFile != "" {
+		scheme = "https://"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, scheme+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := CorrelationID(ctx); id != "" {
+		req.Header.Set(CorrelationIDHeader, id)
+	}
+
+	if c.TokenFile != "" {
+		token, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("failed to read response: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") || json.Unmarshal(respBody, apiErr) != nil {
+			apiErr.Code = ""
+			apiErr.Message = strings.TrimSpace(string(respBody))
+		}
+		return resp.StatusCode >= 500, apiErr
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return false, fmt.Errorf("failed to decode response: %s", err)
+		}
+	}
+	return false, nil
+}
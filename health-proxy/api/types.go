@@ -0,0 +1,143 @@
+// Package api defines the versioned control API of the health-proxy, shared by the health-proxy server and the
+// webhook that drives it.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Version is the control API version spoken by this package.
+	Version = "v1"
+
+	// VersionPath serves the VersionInfo used for the version handshake.
+	VersionPath = "/version"
+	// ServicesPath is the prefix of the per service endpoints: GET ServicesPath/{namespace}/{name} reads the status,
+	// POST ServicesPath/{namespace}/{name}:fail and :reset change the health check.
+	ServicesPath = "/" + Version + "/services/"
+
+	ActionFail  = "fail"
+	ActionReset = "reset"
+
+	// CorrelationIDHeader carries the ID that links the health-proxy's log lines to the webhook request, usually the
+	// admission UID.
+	CorrelationIDHeader = "X-Correlation-Id"
+)
+
+// Error codes returned in Error.Code.
+const (
+	CodeBadRequest       = "BadRequest"
+	CodeUnauthorized     = "Unauthorized"
+	CodeForbidden        = "Forbidden"
+	CodeNotFound         = "NotFound"
+	CodeMethodNotAllowed = "MethodNotAllowed"
+	CodeInternal         = "InternalError"
+)
+
+// ServiceRef identifies a service by namespace and name.
+type ServiceRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (r ServiceRef) String() string {
+	return fmt.Sprintf("%s/%s", r.Namespace, r.Name)
+}
+
+// ServiceStatus is the health check state of a service on a node.
+type ServiceStatus struct {
+	Namespace   string    `json:"namespace"`
+	Name        string    `json:"name"`
+	Terminating bool      `json:"terminating"`
+	FailedSince time.Time `json:"failedSince,omitempty"`
+	// FailedProbes is the number of consecutive 503 responses served since the service was failed.
+	FailedProbes int `json:"failedProbes"`
+	// ProbeSources is the number of distinct probe source addresses that were served a 503.
+	ProbeSources int `json:"probeSources"`
+	// ExpiresAt is when the health-proxy resets the failed health check by itself.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// FailRequest is the body of a :fail request. The health check is reset by the health-proxy once the TTL expires,
+// unless the service is failed again before.
+type FailRequest struct {
+	TTLSeconds int64 `json:"ttlSeconds"`
+}
+
+// VersionInfo lists the control API versions a health-proxy serves.
+type VersionInfo struct {
+	APIVersions []string `json:"apiVersions"`
+}
+
+// Error is the body of every non-2xx response.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// StatusCode is the HTTP status the error was served with.
+	StatusCode int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// ServicePath returns the path of a service endpoint. An empty action addresses the service status.
+func ServicePath(ref ServiceRef, action string) string {
+	path := ServicesPath + ref.Namespace + "/" + ref.Name
+	if action != "" {
+		path += ":" + action
+	}
+	return path
+}
+
+// ParseServicePath is the inverse of ServicePath.
+func ParseServicePath(path string) (ServiceRef, string, error) {
+	parts := strings.Split(strings.TrimPrefix(path, ServicesPath), "/")
+	if !strings.HasPrefix(path, ServicesPath) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ServiceRef{}, "", fmt.Errorf("expected %s{namespace}/{name}[:action], got %s", ServicesPath, path)
+	}
+
+	ref := ServiceRef{Namespace: parts[0], Name: parts[1]}
+	action := ""
+	if i := strings.LastIndex(ref.Name, ":"); i >= 0 {
+		ref.Name, action = ref.Name[:i], ref.Name[i+1:]
+	}
+	return ref, action, nil
+}
+
+// WriteJSON writes a JSON response with the given status code.
+func WriteJSON(rw http.ResponseWriter, statusCode int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		body, _ = json.Marshal(&Error{Code: CodeInternal, Message: err.Error()})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(body)
+}
+
+// WriteError writes a structured error response.
+func WriteError(rw http.ResponseWriter, statusCode int, code, messageFmt string, args ...interface{}) {
+	WriteJSON(rw, statusCode, &Error{Code: code, Message: fmt.Sprintf(messageFmt, args...)})
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a context whose client calls send the correlation ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID of the context, if any.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// healthCheckSubresource is the services subresource callers must be granted in RBAC to drive health checks. It does
+// not exist in the API server, it only names the permission checked by a SubjectAccessReview.
+const healthCheckSubresource = "healthcheck"
+
+// requestAuthorizer authenticates callers by their ServiceAccount bearer token through a TokenReview, and authorizes
+// them for the service with a SubjectAccessReview. Only tokens bound to the audience are accepted, so a caller never
+// sends a token the API server itself would accept. Decisions are cached briefly, so a drain does not cost two API
+// calls per request.
+type requestAuthorizer struct {
+	clientSet *kubernetes.Clientset
+	audience  string
+	ttl       time.Duration
+
+	lock      sync.Mutex
+	decisions map[string]authDecision
+}
+
+type authDecision struct {
+	user    string
+	status  int
+	err     error
+	expires time.Time
+}
+
+func newRequestAuthorizer(clientSet *kubernetes.Clientset, audience string, ttl time.Duration) *requestAuthorizer {
+	return &requestAuthorizer{
+		clientSet: clientSet,
+		audience:  audience,
+		ttl:       ttl,
+		decisions: map[string]authDecision{},
+	}
+}
+
+// Authorize checks that the caller may perform the verb on the health check of the service. It returns the caller's
+// user name, or an error with the HTTP status code to reject the request with.
+func (a *requestAuthorizer) Authorize(req *http.Request, verb string, nsn types.NamespacedName) (string, int, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		return "", http.StatusUnauthorized, fmt.Errorf("missing bearer token")
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := fmt.Sprintf("%s/%s/%s", hex.EncodeToString(sum[:]), verb, nsn)
+	now := time.Now()
+
+	a.lock.Lock()
+	decision, ok := a.decisions[key]
+	a.lock.Unlock()
+	if ok && now.Before(decision.expires) {
+		return decision.user, decision.status, decision.err
+	}
+
+	// Review failures are not cached, the API server may just be briefly unreachable.
+	decision = a.review(req.Context(), token, verb, nsn)
+	if decision.status == http.StatusInternalServerError {
+		return decision.user, decision.status, decision.err
+	}
+	decision.expires = now.Add(a.ttl)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for k, d := range a.decisions {
+		if now.After(d.expires) {
+			delete(a.decisions, k)
+		}
+	}
+	a.decisions[key] = decision
+	return decision.user, decision.status, decision.err
+}
+
+func (a *requestAuthorizer) review(ctx context.Context, token, verb string, nsn types.NamespacedName) authDecision {
+	tr, err := a.clientSet.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{a.audience}},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authDecision{status: http.StatusInternalServerError, err: fmt.Errorf("token review failed: %s", err)}
+	}
+	if !tr.Status.Authenticated {
+		return authDecision{status: http.StatusUnauthorized, err: fmt.Errorf("invalid token: %s", tr.Status.Error)}
+	}
+	if !containsString(tr.Status.Audiences, a.audience) {
+		return authDecision{status: http.StatusUnauthorized, err: fmt.Errorf("token is not bound to audience %s", a.audience)}
+	}
+
+	user := tr.Status.User
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	sar, err := a.clientSet.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   nsn.Namespace,
+				Name:        nsn.Name,
+				Verb:        verb,
+				Resource:    "services",
+				Subresource: healthCheckSubresource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authDecision{user: user.Username, status: http.StatusInternalServerError, err: fmt.Errorf("subject access review failed: %s", err)}
+	}
+	if !sar.Status.Allowed {
+		return authDecision{user: user.Username, status: http.StatusForbidden, err: fmt.Errorf("%s may not %s services/%s of %s: %s", user.Username, verb, healthCheckSubresource, nsn, sar.Status.Reason)}
+	}
+
+	return authDecision{user: user.Username, status: http.StatusOK}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -7,13 +7,15 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/yangl900/pod-terminator/health-proxy/api"
 	"github.com/yangl900/pod-terminator/health-proxy/iptables"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 
 	"k8s.io/client-go/tools/record"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
 // listener allows for testing of ServiceHealthServer and ProxierHealthServer.
@@ -61,8 +63,14 @@ type ServiceHealthServer interface {
 	// existed and are in the new set will be left alone.  The value of the map
 	// is the healthcheck-port to listen on.
 	SyncServices(newServices map[types.NamespacedName]uint16) error
-	FailService(nsn types.NamespacedName) error
+	// FailService fails the health check of the service until it is reset, or until the TTL expires.
+	FailService(nsn types.NamespacedName, ttl time.Duration) error
 	ResetService(nsn types.NamespacedName) error
+	// ExpireServices resets the services whose failure TTL has expired, so an abandoned drain does not keep the node
+	// out of the load balancer forever.
+	ExpireServices()
+	// ServiceStatus reports whether the service is failed, and how many load balancer probes have observed it.
+	ServiceStatus(nsn types.NamespacedName) (api.ServiceStatus, error)
 	Stop()
 }
 
@@ -114,7 +122,7 @@ func (hcs *server) Stop() {
 	}
 }
 
-func (hcs *server) FailService(nsn types.NamespacedName) error {
+func (hcs *server) FailService(nsn types.NamespacedName, ttl time.Duration) error {
 	hcs.lock.Lock()
 	defer hcs.lock.Unlock()
 
@@ -123,8 +131,19 @@ func (hcs *server) FailService(nsn types.NamespacedName) error {
 		return fmt.Errorf("service not found: %s/%s", nsn.Namespace, nsn.Name)
 	}
 
-	klog.V(2).Infof("Setting service %s to fail.", nsn)
-	svc.terminating = true
+	klog.V(2).Infof("Setting service %s to fail for %s.", nsn, ttl)
+	now := time.Now().UTC()
+	if !svc.terminating {
+		svc.terminating = true
+		svc.failedSince = now
+		svc.failedProbes = 0
+		svc.probeSources = map[string]struct{}{}
+		svc.expiresAt = time.Time{}
+	}
+	// Several pods on this node may drain the service, the last one to expire wins.
+	if expiresAt := now.Add(ttl); expiresAt.After(svc.expiresAt) {
+		svc.expiresAt = expiresAt
+	}
 	return nil
 }
 
@@ -140,10 +159,55 @@ func (hcs *server) ResetService(nsn types.NamespacedName) error {
 		return nil
 	}
 
-	svc.terminating = false
+	svc.reset()
 	return nil
 }
 
+func (hcs *server) ExpireServices() {
+	hcs.lock.Lock()
+	defer hcs.lock.Unlock()
+
+	now := time.Now()
+	for nsn, svc := range hcs.services {
+		if !svc.terminating || now.Before(svc.expiresAt) {
+			continue
+		}
+
+		msg := fmt.Sprintf("node %s reset the health check failed since %s, its drain was not finished before %s", hcs.hostname, svc.failedSince, svc.expiresAt)
+		if hcs.recorder != nil {
+			hcs.recorder.Eventf(
+				&v1.ObjectReference{
+					Kind:      "Service",
+					Namespace: nsn.Namespace,
+					Name:      nsn.Name,
+					UID:       types.UID(nsn.String()),
+				}, "Warning", "DrainExpired", msg)
+		}
+		klog.Warningf("Service %s: %s", nsn, msg)
+		svc.reset()
+	}
+}
+
+func (hcs *server) ServiceStatus(nsn types.NamespacedName) (api.ServiceStatus, error) {
+	hcs.lock.RLock()
+	defer hcs.lock.RUnlock()
+
+	svc, ok := hcs.services[nsn]
+	if !ok {
+		return api.ServiceStatus{}, fmt.Errorf("service not found: %s/%s", nsn.Namespace, nsn.Name)
+	}
+
+	return api.ServiceStatus{
+		Namespace:    nsn.Namespace,
+		Name:         nsn.Name,
+		Terminating:  svc.terminating,
+		FailedSince:  svc.failedSince,
+		FailedProbes: svc.failedProbes,
+		ProbeSources: len(svc.probeSources),
+		ExpiresAt:    svc.expiresAt,
+	}, nil
+}
+
 func (hcs *server) SyncServices(newServices map[types.NamespacedName]uint16) error {
 	hcs.lock.Lock()
 	defer hcs.lock.Unlock()
@@ -226,6 +290,18 @@ type hcInstance struct {
 	listener        net.Listener
 	server          httpServer
 	terminating     bool
+	failedSince     time.Time
+	failedProbes    int
+	probeSources    map[string]struct{}
+	expiresAt       time.Time
+}
+
+func (svc *hcInstance) reset() {
+	svc.terminating = false
+	svc.failedSince = time.Time{}
+	svc.failedProbes = 0
+	svc.probeSources = nil
+	svc.expiresAt = time.Time{}
 }
 
 type hcHandler struct {
@@ -236,20 +312,29 @@ type hcHandler struct {
 var _ http.Handler = hcHandler{}
 
 func (h hcHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	h.hcs.lock.RLock()
+	h.hcs.lock.Lock()
 	svc, ok := h.hcs.services[h.name]
 	if !ok || svc == nil {
-		h.hcs.lock.RUnlock()
+		h.hcs.lock.Unlock()
 		resp.WriteHeader(http.StatusInternalServerError)
 		klog.Errorf("Received request for closed healthcheck %q", h.name.String())
 		return
 	}
-	h.hcs.lock.RUnlock()
+
+	// Count the probes that observed the failure, so the webhook knows when the load balancer has noticed.
+	terminating := svc.terminating
+	if terminating {
+		svc.failedProbes++
+		if source, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			svc.probeSources[source] = struct{}{}
+		}
+	}
+	h.hcs.lock.Unlock()
 
 	resp.Header().Set("Content-Type", "application/json")
 	resp.Header().Set("X-Content-Type-Options", "nosniff")
 	resp.Header().Set("Server", "health-proxy")
-	if svc.terminating {
+	if terminating {
 		resp.WriteHeader(http.StatusServiceUnavailable)
 	} else {
 		r, err := http.Get(fmt.Sprintf("http://localhost:%d", svc.healthcheckPort))
@@ -6,7 +6,7 @@ import (
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
 var (
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,43 +13,23 @@ import (
 
 	"context"
 
+	"github.com/go-logr/logr"
+	"github.com/yangl900/pod-terminator/certwatcher"
+	"github.com/yangl900/pod-terminator/health-proxy/api"
 	"github.com/yangl900/pod-terminator/health-proxy/healthcheck"
+	"github.com/yangl900/pod-terminator/kubeclient"
+	"github.com/yangl900/pod-terminator/logging"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
-const podTerminatorAnnotation = "pod-terminator"
-
-type ResourceIDRequest struct {
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
-}
-
-func kubeClientSet(inCluster bool) (*kubernetes.Clientset, error) {
-	var config *rest.Config
-
-	if inCluster {
-		c, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
-		config = c
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	return clientset, nil
-}
-
 func createRecorder(kubeClient *kubernetes.Clientset, userAgent string) record.EventRecorder {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartStructuredLogging(0)
@@ -59,8 +39,17 @@ func createRecorder(kubeClient *kubernetes.Clientset, userAgent string) record.E
 
 func main() {
 	klog.InitFlags(nil)
-	flag.Set("v", "9")
+	annotation := flag.String("annotation", "pod-terminator", "Annotation that opts a service into the health check proxy. Must match the webhook configuration.")
+	maxTTL := flag.Duration("max-fail-ttl", time.Hour, "Longest TTL accepted for a failed health check, longer TTLs are rejected. Failed health checks are reset when their TTL expires. Must match drain.maxFailTTL of the webhook.")
+	listenAddress := flag.String("listen-address", ":10257", "Address to serve the control API on. Must match the container port the webhook looks up.")
+	tlsCertFile := flag.String("tls-cert-file", "", "Serving certificate of the control API. Without it the control API is served over plain HTTP.")
+	tlsKeyFile := flag.String("tls-key-file", "", "Private key of the serving certificate.")
+	tokenAudience := flag.String("token-audience", "pod-terminator-health-proxy", "Audience that callers' tokens must be bound to.")
+	skipAuth := flag.Bool("insecure-skip-authorization", false, "Accept control requests without authenticating the caller. Only for testing.")
+	kubeOptions := &kubeclient.Options{}
+	kubeOptions.AddFlags(flag.CommandLine)
 	flag.Parse()
+	logging.Setup(os.Stderr)
 
 	hostIP, ok := os.LookupEnv("HOST_IP")
 	if !ok {
@@ -68,15 +57,42 @@ func main() {
 		return
 	}
 
-	clientSet, err := kubeClientSet(true)
+	clientSet, err := kubeOptions.ClientSet()
 	if err != nil {
 		klog.Errorf("Failed to create kubeclient: %s \n", err.Error())
 		return
 	}
 	recorder := createRecorder(clientSet, "pod-terminator")
+	auth := newRequestAuthorizer(clientSet, *tokenAudience, time.Minute)
+	authorize := func(rw http.ResponseWriter, req *http.Request, logger logr.Logger, verb string, nsn types.NamespacedName) bool {
+		if *skipAuth {
+			return true
+		}
+
+		user, status, err := auth.Authorize(req, verb, nsn)
+		if err != nil {
+			logger.Error(err, "Rejected control request", "user", user, "verb", verb, "status", status)
+			code := api.CodeInternal
+			switch status {
+			case http.StatusUnauthorized:
+				code = api.CodeUnauthorized
+			case http.StatusForbidden:
+				code = api.CodeForbidden
+			}
+			api.WriteError(rw, status, code, "%s", err)
+			return false
+		}
+
+		logger.V(4).Info("Authorized control request", "user", user, "verb", verb)
+		return true
+	}
+	if *skipAuth {
+		klog.Warningf("Authorization of control requests is disabled, any caller can fail health checks")
+	}
 	server := healthcheck.NewServiceHealthServer("localhost", hostIP, recorder)
 
-	go serviceSyncLoop(server, clientSet)
+	go serviceSyncLoop(server, clientSet, *annotation)
+	go wait.Forever(server.ExpireServices, 10*time.Second)
 	go handleOSSignal(server)
 
 	mux := http.NewServeMux()
@@ -84,84 +100,104 @@ func main() {
 		rw.WriteHeader(200)
 	})
 
-	mux.HandleFunc("/fail", func(rw http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
-			rw.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
+	mux.HandleFunc(api.VersionPath, func(rw http.ResponseWriter, req *http.Request) {
+		api.WriteJSON(rw, http.StatusOK, &api.VersionInfo{APIVersions: []string{api.Version}})
+	})
 
-		body, err := ioutil.ReadAll(req.Body)
+	mux.HandleFunc(api.ServicesPath, func(rw http.ResponseWriter, req *http.Request) {
+		ref, action, err := api.ParseServicePath(req.URL.Path)
 		if err != nil {
-			klog.Errorf("Failed to read request body: %s", err.Error())
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		resID := ResourceIDRequest{}
-		if err := json.Unmarshal(body, &resID); err != nil {
-			klog.Errorf("Failed to read request body: %s", err.Error())
-			rw.WriteHeader(http.StatusInternalServerError)
+			api.WriteError(rw, http.StatusNotFound, api.CodeNotFound, "%s", err)
 			return
 		}
-
-		nsn := types.NamespacedName{
-			Namespace: resID.Namespace,
-			Name:      resID.Name,
-		}
-
-		if err := server.FailService(nsn); err != nil {
-			klog.Errorf("Unable to set service to fail: %s", err.Error())
-			rw.WriteHeader(http.StatusBadRequest)
+		nsn := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+		logger := logging.FromContext(req.Context()).WithValues(
+			"correlationID", req.Header.Get(api.CorrelationIDHeader),
+			"service", nsn.String(),
+			"action", action,
+			"remoteAddr", req.RemoteAddr,
+		)
+
+		verb := "update"
+		switch {
+		case action == "" && req.Method == http.MethodGet:
+			verb = "get"
+		case (action == api.ActionFail || action == api.ActionReset) && req.Method == http.MethodPost:
+		case action != "" && action != api.ActionFail && action != api.ActionReset:
+			api.WriteError(rw, http.StatusNotFound, api.CodeNotFound, "unknown action %q", action)
 			return
-		}
-
-		klog.V(2).Infof("Successfully set service to fail: %s", nsn)
-		rw.WriteHeader(http.StatusOK)
-	})
-
-	mux.HandleFunc("/reset", func(rw http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
-			rw.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			klog.Errorf("Failed to read request body: %s", err.Error())
-			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			api.WriteError(rw, http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, "%s not allowed on %s", req.Method, req.URL.Path)
 			return
 		}
 
-		resID := ResourceIDRequest{}
-		if err := json.Unmarshal(body, &resID); err != nil {
-			klog.Errorf("Failed to read request body: %s", err.Error())
-			rw.WriteHeader(http.StatusInternalServerError)
+		if !authorize(rw, req, logger, verb, nsn) {
 			return
 		}
 
-		nsn := types.NamespacedName{
-			Namespace: resID.Namespace,
-			Name:      resID.Name,
-		}
+		switch action {
+		case api.ActionFail:
+			in := api.FailRequest{}
+			if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+				api.WriteError(rw, http.StatusBadRequest, api.CodeBadRequest, "malformed request body: %s", err)
+				return
+			}
+			if in.TTLSeconds <= 0 {
+				api.WriteError(rw, http.StatusBadRequest, api.CodeBadRequest, "ttlSeconds must be positive")
+				return
+			}
+			// Capping silently would reset the health check while the caller still counts on it being failed.
+			ttl := time.Duration(in.TTLSeconds) * time.Second
+			if ttl > *maxTTL {
+				api.WriteError(rw, http.StatusBadRequest, api.CodeBadRequest, "ttlSeconds %d exceeds the maximum TTL %s", in.TTLSeconds, *maxTTL)
+				return
+			}
 
-		if err := server.ResetService(nsn); err != nil {
-			klog.Errorf("Unable to set service to success: %s", err.Error())
-			rw.WriteHeader(http.StatusBadRequest)
-			return
+			if err := server.FailService(nsn, ttl); err != nil {
+				logger.Error(err, "Unable to set service to fail")
+				api.WriteError(rw, http.StatusNotFound, api.CodeNotFound, "%s", err)
+				return
+			}
+			logger.V(2).Info("Successfully set service to fail", "ttl", ttl)
+			rw.WriteHeader(http.StatusNoContent)
+		case api.ActionReset:
+			if err := server.ResetService(nsn); err != nil {
+				logger.Error(err, "Unable to set service to success")
+				api.WriteError(rw, http.StatusInternalServerError, api.CodeInternal, "%s", err)
+				return
+			}
+			logger.V(2).Info("Successfully set service to success")
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			status, err := server.ServiceStatus(nsn)
+			if err != nil {
+				logger.Error(err, "Unable to get service status")
+				api.WriteError(rw, http.StatusNotFound, api.CodeNotFound, "%s", err)
+				return
+			}
+			api.WriteJSON(rw, http.StatusOK, status)
 		}
-
-		klog.V(2).Infof("Successfully set service to success: %s", nsn)
-		rw.WriteHeader(http.StatusOK)
 	})
 
 	healthProxyServer := &http.Server{
-		Addr:    ":10257",
+		Addr:    *listenAddress,
 		Handler: mux,
 	}
-	klog.Fatal(healthProxyServer.ListenAndServe())
+	if *tlsCertFile == "" {
+		klog.Warningf("Serving the control API without TLS, callers' tokens are sent in plain text")
+		klog.Fatal(healthProxyServer.ListenAndServe())
+	}
+
+	certs, err := certwatcher.New(*tlsCertFile, *tlsKeyFile, 10*time.Second)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	go certs.Run(wait.NeverStop)
+	healthProxyServer.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	klog.Fatal(healthProxyServer.ListenAndServeTLS("", ""))
 }
 
-func serviceSyncLoop(server healthcheck.ServiceHealthServer, clientSet *kubernetes.Clientset) {
+func serviceSyncLoop(server healthcheck.ServiceHealthServer, clientSet *kubernetes.Clientset, annotation string) {
 	for {
 		svcs, err := clientSet.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
 		if err != nil {
@@ -176,7 +212,7 @@ func serviceSyncLoop(server healthcheck.ServiceHealthServer, clientSet *kubernet
 				continue
 			}
 
-			if svc.Annotations == nil || !strings.EqualFold(svc.Annotations[podTerminatorAnnotation], "enabled") {
+			if svc.Annotations == nil || !strings.EqualFold(svc.Annotations[annotation], "enabled") {
 				klog.V(4).Infof("Found svc %s/%s but without annotation, will not proxy health check.", svc.Namespace, svc.Name)
 				continue
 			}
@@ -0,0 +1,57 @@
+// Package kubeclient builds the Kubernetes client of the webhook server and the health-proxy from their command line
+// flags.
+package kubeclient
+
+import (
+	"flag"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Options select the cluster to talk to and the client rate limits.
+type Options struct {
+	Kubeconfig string
+	Context    string
+	Master     string
+	QPS        float64
+	Burst      int
+}
+
+// AddFlags registers the options as command line flags.
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, for running out of cluster. Defaults to the in-cluster config, then to $KUBECONFIG and ~/.kube/config.")
+	fs.StringVar(&o.Context, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&o.Master, "master", "", "The address of the Kubernetes API server, overrides the kubeconfig.")
+	fs.Float64Var(&o.QPS, "kube-api-qps", 20, "QPS to use while talking with the Kubernetes API server.")
+	fs.IntVar(&o.Burst, "kube-api-burst", 30, "Burst to use while talking with the Kubernetes API server.")
+}
+
+// ClientSet builds a client from the given kubeconfig, context and master. With none of them set it uses the
+// in-cluster config, and falls back to the default kubeconfig loading rules when not running in a cluster.
+func (o *Options) ClientSet() (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+
+	if o.Kubeconfig == "" && o.Context == "" && o.Master == "" {
+		config, err = rest.InClusterConfig()
+	}
+	if config == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = o.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{
+			CurrentContext: o.Context,
+			ClusterInfo:    clientcmdapi.Cluster{Server: o.Master},
+		}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config.QPS = float32(o.QPS)
+	config.Burst = o.Burst
+	return kubernetes.NewForConfig(config)
+}
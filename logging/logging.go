@@ -0,0 +1,163 @@
+// Package logging writes structured JSON logs for the webhook server and the health-proxy. It implements logr, and
+// also takes over klog's output, so log lines of client-go are JSON too.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+var base logr.Logger = New(os.Stderr, 0)
+
+// Setup makes a JSON logger at the verbosity of klog's -v flag the default logger, for klog as well. Call it after
+// parsing the flags registered with klog.InitFlags.
+func Setup(w io.Writer) logr.Logger {
+	verbosity := 0
+	if f := flag.Lookup("v"); f != nil {
+		verbosity, _ = strconv.Atoi(f.Value.String())
+	}
+
+	base = New(w, verbosity)
+	klog.SetLogger(base)
+	return base
+}
+
+// FromContext returns the logger of the context, or the default logger.
+func FromContext(ctx context.Context) logr.Logger {
+	if l := logr.FromContext(ctx); l != nil {
+		return l
+	}
+	return base
+}
+
+// NewContext returns a context carrying the logger.
+func NewContext(ctx context.Context, l logr.Logger) context.Context {
+	return logr.NewContext(ctx, l)
+}
+
+// New returns a logger writing one JSON object per line to w. Info lines above the verbosity are dropped.
+func New(w io.Writer, verbosity int) logr.Logger {
+	return &jsonLogger{out: &syncWriter{w: w}, verbosity: verbosity}
+}
+
+type syncWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+type jsonLogger struct {
+	out       *syncWriter
+	verbosity int
+	level     int
+	name      string
+	values    []interface{}
+}
+
+var _ logr.Logger = &jsonLogger{}
+
+func (l *jsonLogger) Enabled() bool {
+	return l.level <= l.verbosity
+}
+
+func (l *jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		l.write("info", msg, nil, keysAndValues)
+	}
+}
+
+func (l *jsonLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.write("error", msg, err, keysAndValues)
+}
+
+func (l *jsonLogger) V(level int) logr.Logger {
+	out := *l
+	out.level += level
+	return &out
+}
+
+func (l *jsonLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	out := *l
+	out.values = append(append([]interface{}{}, l.values...), keysAndValues...)
+	return &out
+}
+
+func (l *jsonLogger) WithName(name string) logr.Logger {
+	out := *l
+	if out.name != "" {
+		name = out.name + "." + name
+	}
+	out.name = name
+	return &out
+}
+
+// write encodes the line by hand, so the fixed fields come first and the key/value pairs keep their order.
+func (l *jsonLogger) write(level, msg string, err error, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString("{")
+	writeField(&b, "ts", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(",")
+	writeField(&b, "level", level)
+	if level == "info" {
+		b.WriteString(",")
+		writeField(&b, "v", l.level)
+	}
+	if l.name != "" {
+		b.WriteString(",")
+		writeField(&b, "logger", l.name)
+	}
+	b.WriteString(",")
+	// klog passes its formatted lines with a trailing newline.
+	writeField(&b, "msg", strings.TrimSuffix(msg, "\n"))
+	if err != nil {
+		b.WriteString(",")
+		writeField(&b, "error", err.Error())
+	}
+
+	kvs := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i < len(kvs); i += 2 {
+		key := fmt.Sprint(kvs[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(kvs) {
+			value = kvs[i+1]
+		}
+		b.WriteString(",")
+		writeField(&b, key, value)
+	}
+	b.WriteString("}\n")
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	io.WriteString(l.out.w, b.String())
+}
+
+func writeField(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case time.Time:
+		// Encoded as RFC 3339 by encoding/json.
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteString(":")
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	b.Write(data)
+}
@@ -1,23 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 )
 
 const (
 	jsonContentType = `application/json`
+	// admissionTimeout bounds the work done for a single admission request. Together with the rollbackTimeout of an
+	// aborted drain it stays below the webhook timeoutSeconds of 10, past which failurePolicy Ignore allows the removal.
+	admissionTimeout = 6 * time.Second
 )
 
 var (
@@ -33,17 +41,14 @@ type patchOperation struct {
 
 // admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
 // operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*v1beta1.AdmissionRequest, *kubernetes.Clientset) (allowed bool, message string, patches []patchOperation, err error)
-
-// isKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
-func isKubeNamespace(ns string) bool {
-	return ns == metav1.NamespacePublic || ns == metav1.NamespaceSystem
-}
+// Requests are always passed as admission.k8s.io/v1, regardless of the version the API server sent. The context is
+// cancelled once the admission deadline passes.
+type admitFunc func(context.Context, *admissionv1.AdmissionRequest) (allowed bool, message string, patches []patchOperation, err error)
 
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
 // bytes.
-func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, clientSet *kubernetes.Clientset) ([]byte, error) {
+func (wh *webhook) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) ([]byte, error) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return nil, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
@@ -60,75 +65,170 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, c
 		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	var admissionReviewReq v1beta1.AdmissionReview
-
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, fmt.Errorf("could not deserialize request: %v", err)
-	} else if admissionReviewReq.Request == nil {
+	}
+
+	var request *admissionv1.AdmissionRequest
+	switch typeMeta.GroupVersionKind().GroupVersion() {
+	case admissionv1.SchemeGroupVersion:
+		var admissionReviewReq admissionv1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, fmt.Errorf("could not deserialize request: %v", err)
+		}
+		request = admissionReviewReq.Request
+	case v1beta1.SchemeGroupVersion:
+		var admissionReviewReq v1beta1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, fmt.Errorf("could not deserialize request: %v", err)
+		}
+		if admissionReviewReq.Request != nil {
+			request = requestFromV1beta1(admissionReviewReq.Request)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported admission review version %q", typeMeta.APIVersion)
+	}
+
+	if request == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, errors.New("malformed admission review: request is nil")
 	}
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		Response: &v1beta1.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
+	response := &admissionv1.AdmissionResponse{
+		UID: request.UID,
 	}
 
+	// Every line logged for this request, also by the health-proxy, carries the admission UID.
+	logger := logging.FromContext(r.Context()).WithValues(
+		"admissionUID", string(request.UID),
+		"operation", string(request.Operation),
+		"pod", podCacheID(request.Namespace, request.Name),
+	)
+	ctx := logging.NewContext(r.Context(), logger)
+	ctx = api.WithCorrelationID(ctx, string(request.UID))
+
 	var patchOps []patchOperation
 	allowed := true
 	result := ""
 
-	if !isKubeNamespace(admissionReviewReq.Request.Namespace) {
-		allowed, result, patchOps, err = admit(admissionReviewReq.Request, clientSet)
+	if currentConfig().Policy.coversNamespace(ctx, wh.cluster.namespaces, request.Namespace) {
+		ctx, cancel := context.WithTimeout(ctx, admissionTimeout)
+		allowed, result, patchOps, err = admit(ctx, request)
+		cancel()
 	}
 
-	if err != nil {
-		admissionReviewResponse.Response.Allowed = false
-		admissionReviewResponse.Response.Result = &metav1.Status{
+	if status, ok := err.(apierrors.APIStatus); ok {
+		response.Allowed = false
+		result := status.Status()
+		response.Result = &result
+	} else if err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{
 			Message: err.Error(),
 		}
 	} else {
-		patchBytes, err := json.Marshal(patchOps)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
+		response.Allowed = allowed
+		response.Result = &metav1.Status{Message: result}
+		if len(patchOps) > 0 {
+			patchBytes, err := json.Marshal(patchOps)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
+			}
+			patchType := admissionv1.PatchTypeJSONPatch
+			response.Patch = patchBytes
+			response.PatchType = &patchType
 		}
-		admissionReviewResponse.Response.Allowed = allowed
-		admissionReviewResponse.Response.Result = &metav1.Status{Message: result}
-		admissionReviewResponse.Response.Patch = patchBytes
 	}
 
-	bytes, err := json.Marshal(&admissionReviewResponse)
+	logger.V(2).Info("Admission request handled", "allowed", response.Allowed, "message", response.Result.Message)
+
+	// Answer in the same version the API server asked in.
+	var admissionReviewResponse interface{}
+	if typeMeta.GroupVersionKind().GroupVersion() == v1beta1.SchemeGroupVersion {
+		admissionReviewResponse = &v1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: responseToV1beta1(response),
+		}
+	} else {
+		admissionReviewResponse = &admissionv1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: response,
+		}
+	}
+
+	bytes, err := json.Marshal(admissionReviewResponse)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
 	return bytes, nil
 }
 
+// requestFromV1beta1 converts a v1beta1 AdmissionRequest into its identical v1 counterpart.
+func requestFromV1beta1(in *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+// responseToV1beta1 converts a v1 AdmissionResponse into its identical v1beta1 counterpart.
+func responseToV1beta1(in *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	out := &v1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		AuditAnnotations: in.AuditAnnotations,
+		Warnings:         in.Warnings,
+	}
+	if in.PatchType != nil {
+		patchType := v1beta1.PatchType(*in.PatchType)
+		out.PatchType = &patchType
+	}
+	return out
+}
+
 // serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
-func serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, clientSet *kubernetes.Clientset) {
-	log.Printf("Handling webhook request %s %s \n", r.Method, r.RequestURI)
+func (wh *webhook) serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+	klog.V(4).InfoS("Handling webhook request", "method", r.Method, "uri", r.RequestURI)
 
 	var writeErr error
-	if bytes, err := doServeAdmitFunc(w, r, admit, clientSet); err != nil {
-		log.Printf("Error handling webhook request: %v", err)
+	if bytes, err := wh.doServeAdmitFunc(w, r, admit); err != nil {
+		klog.ErrorS(err, "Error handling webhook request", "uri", r.RequestURI)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, writeErr = w.Write([]byte(err.Error()))
 	} else {
-		log.Print("Webhook request handled successfully")
+		klog.V(4).InfoS("Webhook request handled successfully", "uri", r.RequestURI)
 		_, writeErr = w.Write(bytes)
 	}
 
 	if writeErr != nil {
-		log.Printf("Could not write response: %v", writeErr)
+		klog.ErrorS(writeErr, "Could not write response", "uri", r.RequestURI)
 	}
 }
 
 // admitFuncHandler takes an admitFunc and wraps it into a http.Handler by means of calling serveAdmitFunc.
-func admitFuncHandler(admit admitFunc, clientSet *kubernetes.Clientset) http.Handler {
+func (wh *webhook) admitFuncHandler(admit admitFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveAdmitFunc(w, r, admit, clientSet)
+		wh.serveAdmitFunc(w, r, admit)
 	})
 }
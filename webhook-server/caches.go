@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// clusterCache serves the objects needed to review an admission request from shared informers, so that admission
+// does not hit the API server on every request.
+type clusterCache struct {
+	factory informers.SharedInformerFactory
+
+	namespaces     corelisters.NamespaceLister
+	pods           corelisters.PodLister
+	services       corelisters.ServiceLister
+	endpointSlices discoverylisters.EndpointSliceLister
+
+	synced []cache.InformerSynced
+	ready  int32
+}
+
+func newClusterCache(clientSet kubernetes.Interface, resync time.Duration) *clusterCache {
+	factory := informers.NewSharedInformerFactory(clientSet, resync)
+
+	namespaces := factory.Core().V1().Namespaces()
+	pods := factory.Core().V1().Pods()
+	services := factory.Core().V1().Services()
+	endpointSlices := factory.Discovery().V1().EndpointSlices()
+
+	return &clusterCache{
+		factory:        factory,
+		namespaces:     namespaces.Lister(),
+		pods:           pods.Lister(),
+		services:       services.Lister(),
+		endpointSlices: endpointSlices.Lister(),
+		synced: []cache.InformerSynced{
+			namespaces.Informer().HasSynced,
+			pods.Informer().HasSynced,
+			services.Informer().HasSynced,
+			endpointSlices.Informer().HasSynced,
+		},
+	}
+}
+
+// Start runs the informers and marks the cache ready once all of them have synced.
+func (c *clusterCache) Start(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+
+	go func() {
+		if !cache.WaitForCacheSync(stopCh, c.synced...) {
+			klog.InfoS("Informer caches did not sync")
+			return
+		}
+
+		klog.InfoS("Informer caches synced")
+		atomic.StoreInt32(&c.ready, 1)
+	}()
+}
+
+// Ready reports whether all informer caches have synced.
+func (c *clusterCache) Ready() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	secretCAKey     = "ca.key"
+	caValidity      = 10 * 365 * 24 * time.Hour
+	servingValidity = 365 * 24 * time.Hour
+)
+
+// certManager bootstraps the webhook's own CA and serving certificate in a Secret, injects the CA into the webhook
+// configurations, and rotates the serving certificate before it expires. It replaces cert-manager where that is not
+// available. Every replica runs it; conflicting writes to the Secret are retried on the next sync.
+type certManager struct {
+	clientSet    kubernetes.Interface
+	namespace    string
+	secretName   string
+	dnsNames     []string
+	rotateBefore time.Duration
+	interval     time.Duration
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertManager(clientSet kubernetes.Interface, namespace, secretName, serviceName string, rotateBefore, interval time.Duration) *certManager {
+	return &certManager{
+		clientSet:  clientSet,
+		namespace:  namespace,
+		secretName: secretName,
+		dnsNames: []string{
+			serviceName,
+			fmt.Sprintf("%s.%s", serviceName, namespace),
+			fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+			fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, namespace),
+		},
+		rotateBefore: rotateBefore,
+		interval:     interval,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.cert == nil {
+		return nil, errors.New("serving certificate not bootstrapped yet")
+	}
+	return m.cert, nil
+}
+
+// Bootstrap syncs until a serving certificate is available.
+func (m *certManager) Bootstrap(stopCh <-chan struct{}) error {
+	return wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+		if err := m.sync(); err != nil {
+			klog.ErrorS(err, "Failed to bootstrap serving certificate", "secret", m.namespace+"/"+m.secretName)
+			return false, nil
+		}
+		return true, nil
+	}, stopCh)
+}
+
+// Run keeps the certificate and CA bundle in sync until the stop channel is closed.
+func (m *certManager) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := m.sync(); err != nil {
+			klog.ErrorS(err, "Failed to sync serving certificate", "secret", m.namespace+"/"+m.secretName)
+		}
+	}, m.interval, stopCh)
+}
+
+func (m *certManager) sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	secrets := m.clientSet.CoreV1().Secrets(m.namespace)
+	secret, err := secrets.Get(ctx, m.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.namespace, Name: m.secretName},
+			Type:       v1.SecretTypeTLS,
+			Data:       map[string][]byte{},
+		}
+		if err := m.issue(secret); err != nil {
+			return err
+		}
+		if secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create secret %s/%s: %s", m.namespace, m.secretName, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read secret %s/%s: %s", m.namespace, m.secretName, err)
+	} else if m.needsRotation(secret) {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		if err := m.issue(secret); err != nil {
+			return err
+		}
+		// The update fails on a conflict when another replica rotated first, the next sync picks that up.
+		if secret, err = secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update secret %s/%s: %s", m.namespace, m.secretName, err)
+		}
+	}
+
+	// Publish the CA bundle before serving a certificate signed by a new CA, otherwise the API server rejects the
+	// handshake until the bundle is injected. A failed injection keeps the previous certificate in use.
+	if err := m.injectCABundle(ctx, secret.Data[v1.ServiceAccountRootCAKey]); err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("failed to load key pair from secret %s/%s: %s", m.namespace, m.secretName, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	m.lock.Lock()
+	changed := m.cert == nil || !bytes.Equal(m.cert.Certificate[0], cert.Certificate[0])
+	m.cert = &cert
+	m.lock.Unlock()
+	if changed {
+		klog.InfoS("Serving certificate", "dnsNames", cert.Leaf.DNSNames, "secret", m.namespace+"/"+m.secretName, "notAfter", cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// needsRotation reports whether the serving certificate in the secret is missing, invalid, or close to expiry.
+func (m *certManager) needsRotation(secret *v1.Secret) bool {
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return true
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(m.rotateBefore).After(leaf.NotAfter)
+}
+
+// issue writes a new serving certificate into the secret. The CA is reused unless it is missing or close to expiry;
+// a new CA is appended to the CA bundle, so the API server keeps trusting the previous one until it expires.
+func (m *certManager) issue(secret *v1.Secret) error {
+	caCert, caKey, err := parseCA(secret.Data[v1.ServiceAccountRootCAKey], secret.Data[secretCAKey])
+	if err != nil || time.Now().Add(m.rotateBefore).After(caCert.NotAfter) {
+		klog.InfoS("Generating a new CA", "secret", m.namespace+"/"+m.secretName)
+		caCert, caKey, err = newCA()
+		if err != nil {
+			return err
+		}
+
+		bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+		for _, old := range validCerts(secret.Data[v1.ServiceAccountRootCAKey]) {
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: old.Raw})...)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(caKey)
+		if err != nil {
+			return err
+		}
+		secret.Data[v1.ServiceAccountRootCAKey] = bundle
+		secret.Data[secretCAKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+
+	certPEM, keyPEM, err := newServingCert(caCert, caKey, m.dnsNames)
+	if err != nil {
+		return err
+	}
+	secret.Data[v1.TLSCertKey] = certPEM
+	secret.Data[v1.TLSPrivateKeyKey] = keyPEM
+
+	klog.InfoS("Issued serving certificate", "dnsNames", m.dnsNames)
+	return nil
+}
+
+// injectCABundle sets the CA bundle on every webhook of the pod-terminator webhook configurations.
+func (m *certManager) injectCABundle(ctx context.Context, caBundle []byte) error {
+	fields := map[string]interface{}{
+		"clientConfig": map[string]interface{}{"caBundle": caBundle},
+	}
+
+	validating, err := m.clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, webhookConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read validating webhook configuration: %s", err)
+	}
+	stale := make([]string, 0)
+	for _, wh := range validating.Webhooks {
+		if !bytes.Equal(wh.ClientConfig.CABundle, caBundle) {
+			stale = append(stale, wh.Name)
+		}
+	}
+	if len(stale) > 0 {
+		data, err := webhooksPatch(stale, fields)
+		if err != nil {
+			return err
+		}
+		if _, err := m.clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Patch(ctx, webhookConfigurationName, types.StrategicMergePatchType, data, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to inject CA bundle into validating webhook configuration: %s", err)
+		}
+		klog.InfoS("Injected CA bundle into validating webhooks", "webhooks", stale)
+	}
+
+	mutating, err := m.clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, webhookConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read mutating webhook configuration: %s", err)
+	}
+	stale = stale[:0]
+	for _, wh := range mutating.Webhooks {
+		if !bytes.Equal(wh.ClientConfig.CABundle, caBundle) {
+			stale = append(stale, wh.Name)
+		}
+	}
+	if len(stale) > 0 {
+		data, err := webhooksPatch(stale, fields)
+		if err != nil {
+			return err
+		}
+		if _, err := m.clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Patch(ctx, webhookConfigurationName, types.StrategicMergePatchType, data, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to inject CA bundle into mutating webhook configuration: %s", err)
+		}
+		klog.InfoS("Injected CA bundle into mutating webhooks", "webhooks", stale)
+	}
+
+	return nil
+}
+
+// webhooksPatch builds a strategic merge patch setting the given fields on the named webhooks. The webhooks list is
+// merged by name, so other fields of each webhook, like their selectors, are kept.
+func webhooksPatch(names []string, fields map[string]interface{}) ([]byte, error) {
+	webhooks := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		wh := map[string]interface{}{"name": name}
+		for k, v := range fields {
+			wh[k] = v
+		}
+		webhooks = append(webhooks, wh)
+	}
+
+	return json.Marshal(map[string]interface{}{"webhooks": webhooks})
+}
+
+func newCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %s", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("pod-terminator-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func newServingCert(caCert *x509.Certificate, caKey crypto.Signer, dnsNames []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serving key: %s", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(servingValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create serving certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// parseCA reads the first certificate of the CA bundle, which is the current CA, and its key.
+func parseCA(bundle, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certs := validCerts(bundle)
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no CA certificate")
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("no CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %s", err)
+	}
+	return certs[0], key, nil
+}
+
+// validCerts decodes the unexpired certificates of a PEM bundle.
+func validCerts(bundle []byte) []*x509.Certificate {
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || time.Now().After(cert.NotAfter) {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
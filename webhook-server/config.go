@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configAPIVersion = "pod-terminator.yangl900.github.io/v1alpha1"
+	configKind       = "WebhookConfiguration"
+)
+
+// webhookConfig is the versioned configuration file of the webhook server. Fields left out of the file keep their
+// defaults.
+type webhookConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ListenAddress and TLSDir are only read on startup.
+	ListenAddress string `json:"listenAddress"`
+	TLSDir        string `json:"tlsDir"`
+
+	// HealthProxyPort is used when the health-proxy pod does not name its port, and by the host IP fallback.
+	HealthProxyPort int               `json:"healthProxyPort"`
+	HealthProxy     healthProxyConfig `json:"healthProxy"`
+	Annotations     annotationConfig  `json:"annotations"`
+	Drain           drainConfig       `json:"drain"`
+	Policy          selectionPolicy   `json:"policy"`
+	// AuditMode runs the full decision logic without touching health checks, and allows every removal.
+	AuditMode bool `json:"auditMode,omitempty"`
+}
+
+// healthProxyConfig locates the health-proxy serving a node: a ready pod in Namespace matching Selector, called on its
+// container port named PortName. Selector defaults to the label app=health-proxy. Without such a pod a removal is
+// denied, unless FallbackToHostIP calls the node's host IP on healthProxyPort instead.
+type healthProxyConfig struct {
+	Namespace        string                `json:"namespace"`
+	Selector         *metav1.LabelSelector `json:"selector"`
+	PortName         string                `json:"portName"`
+	FallbackToHostIP bool                  `json:"fallbackToHostIP,omitempty"`
+}
+
+func (c healthProxyConfig) selector() (labels.Selector, error) {
+	if c.Selector == nil {
+		return labels.SelectorFromSet(labels.Set{"app": "health-proxy"}), nil
+	}
+	return metav1.LabelSelectorAsSelector(c.Selector)
+}
+
+// annotationConfig names the annotations the webhook reads. Enabled must match the annotation the health-proxy
+// looks for on services.
+type annotationConfig struct {
+	Enabled string `json:"enabled"`
+	Delay   string `json:"delay"`
+}
+
+// drainConfig holds the cluster-wide drain settings. A zero MaxDelay leaves the delay unbounded. FailedProbes and
+// ProbeSources allow a removal before the delay once the load balancer probes observed the failure; zero disables the
+// respective check. A drain not finished AbandonAfter past its deadline is given up, and its health checks are reset.
+// MaxFailTTL must match the health-proxy's --max-fail-ttl; delays are capped so that the delay plus AbandonAfter fits.
+type drainConfig struct {
+	DefaultDelay metav1.Duration `json:"defaultDelay"`
+	MaxDelay     metav1.Duration `json:"maxDelay,omitempty"`
+	AbandonAfter metav1.Duration `json:"abandonAfter"`
+	MaxFailTTL   metav1.Duration `json:"maxFailTTL"`
+	FailedProbes int             `json:"failedProbes,omitempty"`
+	ProbeSources int             `json:"probeSources,omitempty"`
+}
+
+func (c drainConfig) probesEnabled() bool {
+	return c.FailedProbes > 0 || c.ProbeSources > 0
+}
+
+func defaultConfig() *webhookConfig {
+	return &webhookConfig{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: configAPIVersion,
+			Kind:       configKind,
+		},
+		ListenAddress:   ":8443",
+		TLSDir:          `/run/secrets/tls`,
+		HealthProxyPort: 10257,
+		HealthProxy: healthProxyConfig{
+			Namespace: "pod-terminator",
+			PortName:  "control",
+		},
+		Annotations: annotationConfig{
+			Enabled: "pod-terminator",
+			Delay:   "pod-terminator-delay",
+		},
+		Drain: drainConfig{
+			DefaultDelay: metav1.Duration{Duration: time.Second * 150},
+			AbandonAfter: metav1.Duration{Duration: time.Minute * 10},
+			MaxFailTTL:   metav1.Duration{Duration: time.Hour},
+		},
+		Policy: *defaultSelectionPolicy(),
+	}
+}
+
+var activeConfig atomic.Value
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the last good configuration. Callers must not modify it.
+func currentConfig() *webhookConfig {
+	return activeConfig.Load().(*webhookConfig)
+}
+
+// parseConfig decodes and validates a configuration file.
+func parseConfig(data []byte) (*webhookConfig, error) {
+	cfg := defaultConfig()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %s", err)
+	}
+
+	if errs := cfg.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config: %s", errs.ToAggregate())
+	}
+	return cfg, nil
+}
+
+func (c *webhookConfig) validate() field.ErrorList {
+	errs := field.ErrorList{}
+
+	if c.APIVersion != configAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{configAPIVersion}))
+	}
+	if c.Kind != configKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{configKind}))
+	}
+	if c.ListenAddress == "" {
+		errs = append(errs, field.Required(field.NewPath("listenAddress"), ""))
+	}
+	if c.TLSDir == "" {
+		errs = append(errs, field.Required(field.NewPath("tlsDir"), ""))
+	}
+	for _, msg := range validation.IsValidPortNum(c.HealthProxyPort) {
+		errs = append(errs, field.Invalid(field.NewPath("healthProxyPort"), c.HealthProxyPort, msg))
+	}
+
+	healthProxyPath := field.NewPath("healthProxy")
+	for _, msg := range validation.IsDNS1123Label(c.HealthProxy.Namespace) {
+		errs = append(errs, field.Invalid(healthProxyPath.Child("namespace"), c.HealthProxy.Namespace, msg))
+	}
+	if selector, err := c.HealthProxy.selector(); err != nil {
+		errs = append(errs, field.Invalid(healthProxyPath.Child("selector"), "", err.Error()))
+	} else if selector.Empty() {
+		errs = append(errs, field.Invalid(healthProxyPath.Child("selector"), "", "must not select every pod"))
+	}
+	for _, msg := range validation.IsValidPortName(c.HealthProxy.PortName) {
+		errs = append(errs, field.Invalid(healthProxyPath.Child("portName"), c.HealthProxy.PortName, msg))
+	}
+
+	annotationsPath := field.NewPath("annotations")
+	for name, key := range map[string]string{"enabled": c.Annotations.Enabled, "delay": c.Annotations.Delay} {
+		for _, msg := range validation.IsQualifiedName(key) {
+			errs = append(errs, field.Invalid(annotationsPath.Child(name), key, msg))
+		}
+	}
+
+	drainPath := field.NewPath("drain")
+	if c.Drain.DefaultDelay.Duration < 0 {
+		errs = append(errs, field.Invalid(drainPath.Child("defaultDelay"), c.Drain.DefaultDelay.Duration.String(), "must not be negative"))
+	}
+	if c.Drain.MaxDelay.Duration < 0 {
+		errs = append(errs, field.Invalid(drainPath.Child("maxDelay"), c.Drain.MaxDelay.Duration.String(), "must not be negative"))
+	}
+	if c.Drain.MaxDelay.Duration > 0 && c.Drain.MaxDelay.Duration < c.Drain.DefaultDelay.Duration {
+		errs = append(errs, field.Invalid(drainPath.Child("maxDelay"), c.Drain.MaxDelay.Duration.String(), "must not be less than drain.defaultDelay"))
+	}
+	if c.Drain.AbandonAfter.Duration <= 0 {
+		errs = append(errs, field.Invalid(drainPath.Child("abandonAfter"), c.Drain.AbandonAfter.Duration.String(), "must be positive"))
+	}
+	if c.Drain.MaxFailTTL.Duration <= c.Drain.AbandonAfter.Duration {
+		errs = append(errs, field.Invalid(drainPath.Child("maxFailTTL"), c.Drain.MaxFailTTL.Duration.String(), "must be more than drain.abandonAfter"))
+	} else {
+		if c.Drain.DefaultDelay.Duration+c.Drain.AbandonAfter.Duration > c.Drain.MaxFailTTL.Duration {
+			errs = append(errs, field.Invalid(drainPath.Child("defaultDelay"), c.Drain.DefaultDelay.Duration.String(), "plus drain.abandonAfter must not exceed drain.maxFailTTL"))
+		}
+		if c.Drain.MaxDelay.Duration+c.Drain.AbandonAfter.Duration > c.Drain.MaxFailTTL.Duration {
+			errs = append(errs, field.Invalid(drainPath.Child("maxDelay"), c.Drain.MaxDelay.Duration.String(), "plus drain.abandonAfter must not exceed drain.maxFailTTL"))
+		}
+	}
+	if c.Drain.FailedProbes < 0 {
+		errs = append(errs, field.Invalid(drainPath.Child("failedProbes"), c.Drain.FailedProbes, "must not be negative"))
+	}
+	if c.Drain.ProbeSources < 0 {
+		errs = append(errs, field.Invalid(drainPath.Child("probeSources"), c.Drain.ProbeSources, "must not be negative"))
+	}
+
+	if err := c.Policy.compile(); err != nil {
+		errs = append(errs, field.Invalid(field.NewPath("policy"), "", err.Error()))
+	}
+
+	return errs
+}
+
+// configWatcher reloads the configuration file whenever its content changes. An invalid file is rejected and the
+// last good configuration stays in effect.
+type configWatcher struct {
+	path     string
+	interval time.Duration
+	onReload func(old, new *webhookConfig)
+
+	data []byte
+}
+
+func newConfigWatcher(path string, interval time.Duration, onReload func(old, new *webhookConfig)) *configWatcher {
+	return &configWatcher{
+		path:     path,
+		interval: interval,
+		onReload: onReload,
+	}
+}
+
+// Load reads the configuration file once and makes it the active configuration.
+func (w *configWatcher) Load() error {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %s", w.path, err)
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("config %s: %s", w.path, err)
+	}
+
+	w.data = data
+	activeConfig.Store(cfg)
+	return nil
+}
+
+// Run polls the configuration file until the stop channel is closed. Polling, rather than watching for file events,
+// also picks up ConfigMap updates, which swap a symlink instead of writing the file.
+func (w *configWatcher) Run(stopCh <-chan struct{}) {
+	wait.Until(w.reload, w.interval, stopCh)
+}
+
+func (w *configWatcher) reload() {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read config, keeping last good config", "path", w.path)
+		return
+	}
+
+	if bytes.Equal(data, w.data) {
+		return
+	}
+	w.data = data
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		klog.ErrorS(err, "Rejected config, keeping last good config", "path", w.path)
+		return
+	}
+
+	old := currentConfig()
+	if cfg.ListenAddress != old.ListenAddress || cfg.TLSDir != old.TLSDir {
+		klog.InfoS("Config changes listenAddress or tlsDir, which take effect after a restart", "path", w.path)
+	}
+
+	activeConfig.Store(cfg)
+	klog.InfoS("Reloaded config", "path", w.path)
+
+	if w.onReload != nil {
+		w.onReload(old, cfg)
+	}
+}
+
+// policyChanged reports whether the selection policy differs between two configurations.
+func policyChanged(old, new *webhookConfig) bool {
+	return !reflect.DeepEqual(old.Policy.IncludeNamespaces, new.Policy.IncludeNamespaces) ||
+		!reflect.DeepEqual(old.Policy.ExcludeNamespaces, new.Policy.ExcludeNamespaces) ||
+		!reflect.DeepEqual(old.Policy.NamespaceSelector, new.Policy.NamespaceSelector) ||
+		!reflect.DeepEqual(old.Policy.ObjectSelector, new.Policy.ObjectSelector)
+}
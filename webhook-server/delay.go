@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+)
+
+// parseDelay accepts a Go duration such as "90s" or "2m", or a plain number of seconds.
+func parseDelay(val string) (time.Duration, error) {
+	val = strings.TrimSpace(val)
+
+	delay, err := time.ParseDuration(val)
+	if err != nil {
+		sec, convErr := strconv.Atoi(val)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid delay %q: expect a duration like 90s or a number of seconds", val)
+		}
+		delay = time.Second * time.Duration(sec)
+	}
+
+	if delay < 0 {
+		return 0, fmt.Errorf("invalid delay %q: must not be negative", val)
+	}
+	return delay, nil
+}
+
+// effectiveDelay resolves the drain delay of a pod. The pod annotation wins, then the longest delay annotated on
+// the drained services, then the cluster default. The result is capped at the cluster maximum, and so that the drain
+// fits in the health-proxy maximum TTL. It returns the delay, a description of where it came from, and warnings to
+// surface in the admission message.
+func (wh *webhook) effectiveDelay(ctx context.Context, pod *v1.Pod, services []api.ServiceRef) (time.Duration, string, []string) {
+	cfg := currentConfig()
+	delayAnnotation := cfg.Annotations.Delay
+	maxDelay := cfg.Drain.MaxDelay.Duration
+
+	warnings := make([]string, 0)
+	delay, source := cfg.Drain.DefaultDelay.Duration, "cluster default"
+	fromAnnotation := false
+
+	serviceDelay := time.Duration(-1)
+	for _, rr := range services {
+		svc, err := wh.cluster.services.Services(rr.Namespace).Get(rr.Name)
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "Failed to read service for drain delay", "service", rr.String())
+			continue
+		}
+
+		val, ok := svc.Annotations[delayAnnotation]
+		if !ok {
+			continue
+		}
+
+		d, err := parseDelay(val)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignored %s annotation of service %s/%s: %s", delayAnnotation, rr.Namespace, rr.Name, err))
+			continue
+		}
+
+		if d > serviceDelay {
+			serviceDelay = d
+			source = fmt.Sprintf("service %s/%s annotation", rr.Namespace, rr.Name)
+		}
+	}
+	if serviceDelay >= 0 {
+		delay = serviceDelay
+		fromAnnotation = true
+	}
+
+	if val, ok := pod.Annotations[delayAnnotation]; ok {
+		d, err := parseDelay(val)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignored %s annotation of pod: %s", delayAnnotation, err))
+		} else {
+			delay, source = d, "pod annotation"
+			fromAnnotation = true
+		}
+	}
+
+	if maxDelay > 0 && delay > maxDelay {
+		warnings = append(warnings, fmt.Sprintf("delay %s from %s capped at cluster maximum %s", delay, source, maxDelay))
+		delay = maxDelay
+	}
+
+	// The health-proxy resets the health check after its maximum TTL, a longer drain would end with traffic restored.
+	if ttlDelay := cfg.Drain.MaxFailTTL.Duration - cfg.Drain.AbandonAfter.Duration; delay > ttlDelay {
+		warnings = append(warnings, fmt.Sprintf("delay %s from %s capped at %s to fit the health-proxy maximum TTL %s", delay, source, ttlDelay, cfg.Drain.MaxFailTTL.Duration))
+		delay = ttlDelay
+	}
+
+	if fromAnnotation && pod.Spec.TerminationGracePeriodSeconds != nil {
+		grace := time.Second * time.Duration(*pod.Spec.TerminationGracePeriodSeconds)
+		if delay > grace {
+			warnings = append(warnings, fmt.Sprintf("delay %s exceeds terminationGracePeriodSeconds %s", delay, grace))
+		}
+	}
+
+	return delay, source, warnings
+}
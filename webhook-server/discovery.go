@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+)
+
+// healthProxyAddress returns the address of the health-proxy serving the node: the pod IP and control port of a ready
+// health-proxy pod on the node, found through the pod informer. Without one it falls back to the host IP if
+// configured, and fails otherwise.
+func (wh *webhook) healthProxyAddress(ctx context.Context, nodeName, hostIP string) (string, error) {
+	cfg := currentConfig()
+	selector, err := cfg.HealthProxy.selector()
+	if err != nil {
+		return "", fmt.Errorf("invalid health-proxy selector: %s", err)
+	}
+
+	pods, err := wh.cluster.pods.Pods(cfg.HealthProxy.Namespace).List(selector)
+	if err != nil {
+		return "", fmt.Errorf("failed to list health-proxy pods: %s", err)
+	}
+
+	// Pick the same pod on every call while a DaemonSet rollout briefly runs two on the node.
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName || !isPodReady(pod) {
+			continue
+		}
+		port := containerPort(pod, cfg.HealthProxy.PortName, cfg.HealthProxyPort)
+		return net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)), nil
+	}
+
+	if cfg.HealthProxy.FallbackToHostIP && hostIP != "" {
+		logging.FromContext(ctx).V(2).Info("No ready health-proxy pod on node, falling back to host IP", "node", nodeName, "hostIP", hostIP)
+		return net.JoinHostPort(hostIP, strconv.Itoa(cfg.HealthProxyPort)), nil
+	}
+	return "", fmt.Errorf("no ready health-proxy pod matching %s in namespace %s on node %s", selector, cfg.HealthProxy.Namespace, nodeName)
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.PodIP == "" {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// containerPort returns the number of the pod's container port with the given name, or defaultPort if there is none.
+func containerPort(pod *v1.Pod, name string, defaultPort int) int {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == name {
+				return int(p.ContainerPort)
+			}
+		}
+	}
+	return defaultPort
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+)
+
+// rollbackTimeout bounds the resets of a failed drain. The resets do not share the admission context, which may
+// already have run out when they start.
+const rollbackTimeout = 3 * time.Second
+
+// healthProxyClient is the part of the health-proxy API the webhook uses. *api.Client implements it.
+type healthProxyClient interface {
+	FailService(ctx context.Context, addr string, ref api.ServiceRef, ttl time.Duration) error
+	ResetService(ctx context.Context, addr string, ref api.ServiceRef) error
+	ServiceStatus(ctx context.Context, addr string, ref api.ServiceRef) (*api.ServiceStatus, error)
+}
+
+var _ healthProxyClient = &api.Client{}
+
+// serviceOutcome is the result of failing the health check of one service of a drain, and of rolling it back.
+type serviceOutcome struct {
+	Service     api.ServiceRef
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+	// Held is set if the rollback left the service failed for another drain on the node.
+	Held bool
+}
+
+func (o serviceOutcome) String() string {
+	switch {
+	case o.Err != nil:
+		return fmt.Sprintf("%s: %v", o.Service, o.Err)
+	case o.RollbackErr != nil:
+		return fmt.Sprintf("%s: failed, reset failed: %v", o.Service, o.RollbackErr)
+	case o.RolledBack:
+		return fmt.Sprintf("%s: failed, reset", o.Service)
+	case o.Held:
+		return fmt.Sprintf("%s: failed, held by another drain", o.Service)
+	default:
+		return fmt.Sprintf("%s: failed", o.Service)
+	}
+}
+
+func outcomesString(outcomes []serviceOutcome) string {
+	parts := make([]string, 0, len(outcomes))
+	for _, o := range outcomes {
+		parts = append(parts, o.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// failServices fails the health check of all services on the health-proxy at addr in parallel, so they share one drain
+// deadline. Either every service is failed, or the services that were failed are reset again and an error is
+// returned. The outcomes list each service in order. The health-proxy resets the services by itself after the TTL.
+func (wh *webhook) failServices(ctx context.Context, pod *v1.Pod, addr string, services []api.ServiceRef, ttl time.Duration) ([]serviceOutcome, error) {
+	outcomes := make([]serviceOutcome, len(services))
+
+	var wg sync.WaitGroup
+	for i, rr := range services {
+		wg.Add(1)
+		go func(i int, rr api.ServiceRef) {
+			defer wg.Done()
+			outcomes[i] = serviceOutcome{Service: rr, Err: wh.healthProxy.FailService(ctx, addr, rr, ttl)}
+		}(i, rr)
+	}
+	wg.Wait()
+
+	logger := logging.FromContext(ctx)
+	failed := 0
+	for _, o := range outcomes {
+		if o.Err != nil {
+			failed++
+			logger.Error(o.Err, "Failed to fail health check", "service", o.Service.String(), "node", pod.Spec.NodeName)
+			healthProxyFailures.WithLabelValues(o.Service.Namespace, o.Service.Name, "fail").Inc()
+			wh.recordDrainEvent(pod, []api.ServiceRef{o.Service}, v1.EventTypeWarning, eventHealthProxyUnreachable, "Failed to fail health check on node %s: %v", pod.Spec.NodeName, o.Err)
+		}
+	}
+	if failed == 0 {
+		return outcomes, nil
+	}
+
+	wh.rollbackServices(ctx, pod, addr, outcomes)
+	return outcomes, fmt.Errorf("failed %d of %d services", failed, len(services))
+}
+
+// rollbackServices resets the services that were failed, except those another drain on the node holds, which that
+// drain resets. A service that cannot be reset stays failed until its next drain finishes, which the Warning event
+// points out.
+func (wh *webhook) rollbackServices(parent context.Context, pod *v1.Pod, addr string, outcomes []serviceOutcome) {
+	// Keep the logger and correlation ID, but not the deadline of the parent context.
+	logger := logging.FromContext(parent)
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	ctx = api.WithCorrelationID(logging.NewContext(ctx, logger), api.CorrelationID(parent))
+
+	failed := make([]api.ServiceRef, 0, len(outcomes))
+	for _, o := range outcomes {
+		if o.Err == nil {
+			failed = append(failed, o.Service)
+		}
+	}
+	release, err := wh.drains.Releasable(ctx, podCacheID(pod.Namespace, pod.Name), pod.Spec.NodeName, failed)
+	if err != nil {
+		// Resetting a held service would end the other drain early, leave them all to the health-proxy's TTL.
+		logger.Error(err, "Failed to read drains on node, leaving health checks failed until the TTL expires", "services", serviceNames(failed), "node", pod.Spec.NodeName)
+		wh.recordDrainEvent(pod, failed, v1.EventTypeWarning, eventDrainAborted, "Left health check failed on node %s after aborted drain until its TTL expires: %v", pod.Spec.NodeName, err)
+	}
+	releasable := map[api.ServiceRef]bool{}
+	for _, rr := range release {
+		releasable[rr] = true
+	}
+
+	var wg sync.WaitGroup
+	for i := range outcomes {
+		if outcomes[i].Err != nil {
+			continue
+		}
+		if !releasable[outcomes[i].Service] {
+			outcomes[i].Held = err == nil
+			continue
+		}
+
+		wg.Add(1)
+		go func(o *serviceOutcome) {
+			defer wg.Done()
+			o.RollbackErr = wh.healthProxy.ResetService(ctx, addr, o.Service)
+			o.RolledBack = o.RollbackErr == nil
+		}(&outcomes[i])
+	}
+	wg.Wait()
+
+	for _, o := range outcomes {
+		if o.RollbackErr != nil {
+			logger.Error(o.RollbackErr, "Failed to reset health check after aborted drain", "service", o.Service.String(), "node", pod.Spec.NodeName)
+			healthProxyFailures.WithLabelValues(o.Service.Namespace, o.Service.Name, "reset").Inc()
+			wh.recordDrainEvent(pod, []api.ServiceRef{o.Service}, v1.EventTypeWarning, eventHealthProxyUnreachable, "Failed to reset health check on node %s after aborted drain: %v", pod.Spec.NodeName, o.RollbackErr)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// podDrainStateAnnotation holds the JSON encoded drainState of a pod that is being drained.
+	podDrainStateAnnotation = "pod-terminator-drain"
+	// podDrainingLabel marks pods carrying drain state, so they can be listed without scanning every pod.
+	podDrainingLabel = "pod-terminator-draining"
+
+	// triggerDelete and triggerEviction record how the pod removal that started a drain was requested.
+	triggerDelete   = "delete"
+	triggerEviction = "eviction"
+)
+
+// drainState is the durable record of a pod drain: when it started, when the pod may be deleted, which services
+// were failed on the health-proxy, and on which node.
+type drainState struct {
+	StartTime   time.Time        `json:"startTime"`
+	Deadline    time.Time        `json:"deadline"`
+	Delay       string           `json:"delay,omitempty"`
+	DelaySource string           `json:"delaySource,omitempty"`
+	Services    []api.ServiceRef `json:"services"`
+	NodeName    string           `json:"nodeName"`
+	HostIP      string           `json:"hostIP"`
+	Trigger     string           `json:"trigger,omitempty"`
+}
+
+// drainStore persists drain state outside of the webhook process, so that it survives restarts and is shared
+// between replicas.
+type drainStore interface {
+	Save(ctx context.Context, namespace, name string, state *drainState) error
+	Delete(ctx context.Context, namespace, name string) error
+	List(ctx context.Context) (map[string]*drainState, error)
+}
+
+// annotationDrainStore keeps the drain state as an annotation on the pod itself.
+type annotationDrainStore struct {
+	clientSet kubernetes.Interface
+}
+
+var _ drainStore = &annotationDrainStore{}
+
+func newAnnotationDrainStore(clientSet kubernetes.Interface) drainStore {
+	return &annotationDrainStore{clientSet: clientSet}
+}
+
+func (s *annotationDrainStore) Save(ctx context.Context, namespace, name string, state *drainState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal drain state: %s", err)
+	}
+
+	return s.patch(ctx, namespace, name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{podDrainingLabel: "true"},
+			"annotations": map[string]interface{}{podDrainStateAnnotation: string(raw)},
+		},
+	})
+}
+
+func (s *annotationDrainStore) Delete(ctx context.Context, namespace, name string) error {
+	err := s.patch(ctx, namespace, name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{podDrainingLabel: nil},
+			"annotations": map[string]interface{}{podDrainStateAnnotation: nil},
+		},
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *annotationDrainStore) List(ctx context.Context) (map[string]*drainState, error) {
+	pods, err := s.clientSet.CoreV1().Pods("").List(ctx, metav1.ListOptions{LabelSelector: podDrainingLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list draining pods: %s", err)
+	}
+
+	states := map[string]*drainState{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		state, err := drainStateFromPod(pod)
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "Ignoring drain state", "pod", podCacheID(pod.Namespace, pod.Name))
+			continue
+		}
+		if state != nil {
+			states[podCacheID(pod.Namespace, pod.Name)] = state
+		}
+	}
+
+	return states, nil
+}
+
+func (s *annotationDrainStore) patch(ctx context.Context, namespace, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.clientSet.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+// drainStateFromPod decodes the drain state annotation of the pod. It returns nil if the pod is not being drained.
+func drainStateFromPod(pod *v1.Pod) (*drainState, error) {
+	raw, ok := pod.Annotations[podDrainStateAnnotation]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+
+	state := &drainState{}
+	if err := json.Unmarshal([]byte(raw), state); err != nil {
+		return nil, fmt.Errorf("malformed %s annotation: %s", podDrainStateAnnotation, err)
+	}
+	return state, nil
+}
+
+func podCacheID(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// drainCache is the webhook's local view of all drains, written through to a drainStore.
+type drainCache struct {
+	store drainStore
+
+	lock   sync.RWMutex
+	drains map[string]*drainState
+}
+
+func newDrainCache(store drainStore) *drainCache {
+	return &drainCache{
+		store:  store,
+		drains: map[string]*drainState{},
+	}
+}
+
+// Sync rebuilds the cache from the store.
+func (c *drainCache) Sync(ctx context.Context) error {
+	drains, err := c.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.drains = drains
+	return nil
+}
+
+// Run resyncs the cache from the store every interval until the stop channel is closed, so that drains started or
+// finished by other replicas show up in this replica's cache and metrics.
+func (c *drainCache) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := c.Sync(ctx); err != nil {
+			klog.ErrorS(err, "Failed to sync drain state")
+		}
+	}, interval, stopCh)
+}
+
+// Get returns the drain state of the pod. The state recorded on the pod wins over the local view, because another
+// replica may have started or finished the drain.
+func (c *drainCache) Get(ctx context.Context, pod *v1.Pod) (*drainState, bool) {
+	cacheID := podCacheID(pod.Namespace, pod.Name)
+
+	state, err := drainStateFromPod(pod)
+	if err != nil {
+		logging.FromContext(ctx).Error(err, "Failed to read drain state")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if state != nil {
+		c.drains[cacheID] = state
+		return state, true
+	}
+
+	delete(c.drains, cacheID)
+	return nil, false
+}
+
+// Put records the drain state of the pod in the store and in the cache.
+func (c *drainCache) Put(ctx context.Context, namespace, name string, state *drainState) error {
+	if err := c.store.Save(ctx, namespace, name, state); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.drains[podCacheID(namespace, name)] = state
+	return nil
+}
+
+// Remove forgets the drain state of the pod in the store and in the cache.
+func (c *drainCache) Remove(ctx context.Context, namespace, name string) error {
+	if err := c.store.Delete(ctx, namespace, name); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.drains, podCacheID(namespace, name))
+	return nil
+}
+
+// Expired returns a copy of all drains whose deadline has passed.
+func (c *drainCache) Expired(now time.Time) map[string]*drainState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	expired := map[string]*drainState{}
+	for id, state := range c.drains {
+		if now.After(state.Deadline) {
+			expired[id] = state
+		}
+	}
+	return expired
+}
+
+// NodeDrains returns the drains of pods on the node other than the pod with the given cache ID, read from the store.
+// Which drains hold a node's services must be current: the cache only learns of drains started by other replicas on
+// the next Sync.
+func (c *drainCache) NodeDrains(ctx context.Context, nodeName, cacheID string) (map[string]*drainState, error) {
+	drains, err := c.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, state := range drains {
+		if id == cacheID || state.NodeName != nodeName {
+			delete(drains, id)
+		}
+	}
+	return drains, nil
+}
+
+// Releasable returns the services that no drain on the node other than the pod's holds. The health-proxy keeps one
+// failed flag per service and node, so resetting a held service would end the other drain early.
+func (c *drainCache) Releasable(ctx context.Context, cacheID, nodeName string, services []api.ServiceRef) ([]api.ServiceRef, error) {
+	others, err := c.NodeDrains(ctx, nodeName, cacheID)
+	if err != nil {
+		return nil, err
+	}
+
+	held := map[api.ServiceRef]bool{}
+	for _, other := range others {
+		for _, rr := range other.Services {
+			held[rr] = true
+		}
+	}
+
+	releasable := make([]api.ServiceRef, 0, len(services))
+	for _, rr := range services {
+		if !held[rr] {
+			releasable = append(releasable, rr)
+		}
+	}
+	return releasable, nil
+}
+
+// List returns a copy of all known drains.
+func (c *drainCache) List() map[string]*drainState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	drains := make(map[string]*drainState, len(c.drains))
+	for id, state := range c.drains {
+		drains[id] = state
+	}
+	return drains
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Reasons of the Events recorded for each phase of a drain.
+const (
+	eventDrainStarted           = "DrainStarted"
+	eventDrainWaiting           = "DrainWaiting"
+	eventDrainCompleted         = "DrainCompleted"
+	eventDrainAborted           = "DrainAborted"
+	eventDrainAbandoned         = "DrainAbandoned"
+	eventHealthProxyUnreachable = "HealthProxyUnreachable"
+)
+
+// recordDrainEvent records an Event on the pod and on each of the given services, so that both
+// `kubectl describe pod` and `kubectl describe service` explain the drain.
+func (wh *webhook) recordDrainEvent(pod *v1.Pod, services []api.ServiceRef, eventType, reason, messageFmt string, args ...interface{}) {
+	if wh.recorder == nil {
+		return
+	}
+
+	msg := fmt.Sprintf(messageFmt, args...)
+	wh.recorder.Event(pod, eventType, reason, msg)
+
+	for _, rr := range services {
+		ref := &v1.ObjectReference{
+			Kind:       "Service",
+			APIVersion: "v1",
+			Namespace:  rr.Namespace,
+			Name:       rr.Name,
+		}
+		wh.recorder.Eventf(ref, eventType, reason, "Pod %s/%s: %s", pod.Namespace, pod.Name, msg)
+	}
+}
+
+func serviceNames(services []api.ServiceRef) string {
+	names := make([]string, 0, len(services))
+	for _, rr := range services {
+		names = append(names, fmt.Sprintf("%s/%s", rr.Namespace, rr.Name))
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
@@ -1,195 +1,563 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
+	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
-	"k8s.io/api/admission/v1beta1"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yangl900/pod-terminator/certwatcher"
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/kubeclient"
+	"github.com/yangl900/pod-terminator/logging"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 )
 
 const (
-	tlsDir                        = `/run/secrets/tls`
-	tlsCertFile                   = `tls.crt`
-	tlsKeyFile                    = `tls.key`
-	podTerminatorAnnotation       = "pod-terminator"
-	podTerminationDelayAnnotation = "pod-terminator-delay"
-	defaultDelay                  = time.Second * 150
+	tlsCertFile         = `tls.crt`
+	tlsKeyFile          = `tls.key`
+	evictionSubResource = "eviction"
+	// evictionRetrySeconds is the retry hint given to eviction clients when no drain deadline is known.
+	evictionRetrySeconds = 10
 )
 
-var (
-	podResource   = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
-	deletionCache = map[string]time.Time{}
-)
+var podResource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
 
-type ResourceIDRequest struct {
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
+// webhook holds the dependencies of the admission logic, so that it can run against a fake clientset, health-proxy
+// and clock.
+type webhook struct {
+	clientSet   kubernetes.Interface
+	cluster     *clusterCache
+	drains      *drainCache
+	recorder    record.EventRecorder
+	healthProxy healthProxyClient
+	// clock times drain deadlines.
+	clock clock.Clock
 }
 
-func validateDeletion(req *v1beta1.AdmissionRequest, clientSet *kubernetes.Clientset) (bool, string, []patchOperation, error) {
+func (wh *webhook) validateDeletion(ctx context.Context, req *admissionv1.AdmissionRequest) (bool, string, []patchOperation, error) {
+	logger := logging.FromContext(ctx)
 	if req.Resource != podResource {
-		log.Printf("expect resource to be %s", podResource)
+		logger.Info("Unexpected resource, allowing", "expected", podResource.String(), "resource", req.Resource.String())
 		return true, "", nil, nil
 	}
 
-	if req.Operation != v1beta1.Delete {
-		log.Printf("Allow non-deletion operation %v", req.Operation)
+	var trigger string
+	switch {
+	case req.SubResource == "" && req.Operation == admissionv1.Delete:
+		trigger = triggerDelete
+	case req.SubResource == evictionSubResource && req.Operation == admissionv1.Create:
+		trigger = triggerEviction
+	default:
+		logger.V(2).Info("Allow operation on subresource", "operation", req.Operation, "subresource", req.SubResource)
 		return true, "", nil, nil
 	}
 
-	cacheID := fmt.Sprintf("%s/%s", req.Namespace, req.Name)
+	if req.DryRun != nil && *req.DryRun {
+		logger.Info("Allow dry run without side effects", "trigger", trigger)
+		return true, "Dry run, pre-deletion-hook skipped.", nil, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		admissionLatency.WithLabelValues(req.Namespace).Observe(time.Since(start).Seconds())
+	}()
+
+	auditMode := currentConfig().AuditMode
+	allowed, reason, deadline := false, "Webhook caches are not synced yet, retry later.", time.Time{}
+	if wh.cluster.Ready() {
+		allowed, reason, deadline = wh.reviewPodRemoval(ctx, req.Namespace, req.Name, trigger)
+	}
+
+	switch {
+	case allowed || auditMode:
+		admissionDecisions.WithLabelValues(req.Namespace, decisionAllowed).Inc()
+	case !deadline.IsZero():
+		admissionDecisions.WithLabelValues(req.Namespace, decisionDeniedDraining).Inc()
+	default:
+		admissionDecisions.WithLabelValues(req.Namespace, decisionError).Inc()
+	}
+
+	if allowed {
+		return true, reason, nil, nil
+	}
+
+	if auditMode {
+		return wh.auditRemoval(ctx, req.Namespace, req.Name, trigger, reason)
+	}
+	return wh.denyRemoval(trigger, reason, deadline)
+}
+
+// auditRemoval allows a pod removal the webhook would have denied, and records what it would have done.
+func (wh *webhook) auditRemoval(ctx context.Context, namespace, name, trigger, reason string) (bool, string, []patchOperation, error) {
+	msg := fmt.Sprintf("Audit mode, allowing %s. %s", trigger, reason)
+	logging.FromContext(ctx).Info("Audit mode, allowing", "trigger", trigger, "reason", reason)
+	wh.recorder.Event(&v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}, v1.EventTypeNormal, "DrainAudited", msg)
+	return true, msg, nil, nil
+}
+
+// denyRemoval rejects a pod removal. Evictions are rejected with 429 Too Many Requests and a retry hint, which
+// eviction clients such as kubectl drain understand and retry on.
+func (wh *webhook) denyRemoval(trigger, reason string, deadline time.Time) (bool, string, []patchOperation, error) {
+	if trigger != triggerEviction {
+		return false, reason, nil, nil
+	}
+
+	retryAfter := int(math.Ceil(deadline.Sub(wh.clock.Now()).Seconds()))
+	if deadline.IsZero() || retryAfter < 1 {
+		retryAfter = evictionRetrySeconds
+	}
+	return false, "", nil, apierrors.NewTooManyRequests(reason, retryAfter)
+}
+
+// reviewPodRemoval runs the drain flow for a pod that is being deleted or evicted. It returns whether the removal is
+// allowed, the reason, and the drain deadline if one is pending.
+func (wh *webhook) reviewPodRemoval(ctx context.Context, namespace, name, trigger string) (bool, string, time.Time) {
+	cacheID := podCacheID(namespace, name)
+	logger := logging.FromContext(ctx)
 
-	log.Printf("Reviewing pod deletion operation: %s", cacheID)
+	logger.V(2).Info("Reviewing pod removal", "trigger", trigger)
 
-	pod, err := clientSet.CoreV1().Pods(req.Namespace).Get(context.Background(), req.Name, metav1.GetOptions{})
+	pod, err := wh.cluster.pods.Pods(namespace).Get(name)
 	if err != nil {
-		return false, fmt.Sprintf("Failed to read pod %s/%s: %v", req.Namespace, req.Name, err), nil, nil
+		return false, fmt.Sprintf("Failed to read pod %s/%s: %v", namespace, name, err), time.Time{}
 	}
 
 	if pod.DeletionTimestamp != nil {
-		log.Printf("Pod %s in terminating, allow deletion.", cacheID)
-		return true, "Pod in terminating, allow deletion.", nil, nil
+		logger.Info("Pod in terminating, allow deletion")
+		return true, "Pod in terminating, allow deletion.", time.Time{}
 	}
 
-	if val, ok := pod.Annotations[podTerminatorAnnotation]; !ok || strings.EqualFold(val, "false") {
-		log.Printf("Pod %s does not have annotation, allow deletion.", cacheID)
-		return true, "Pod does not have annotation, allow deletion.", nil, nil
+	if !currentConfig().Policy.coversPod(pod) {
+		logger.V(2).Info("Pod is not selected by the policy, allow deletion")
+		return true, "Pod is not selected by the policy, allow deletion.", time.Time{}
 	}
 
-	rrs, err := findService(clientSet, req.Namespace, req.Name, pod.Status.PodIP)
-	if err != nil {
-		return false, fmt.Sprintf("Failed to locate service for pod %s/%s: %s", req.Namespace, req.Name, err), nil, nil
+	if !wh.podOptedIn(ctx, pod) {
+		logger.V(2).Info("Pod does not have annotation, allow deletion")
+		return true, "Pod does not have annotation, allow deletion.", time.Time{}
 	}
 
-	for _, rr := range rrs {
-		reqBody, err := json.Marshal(rr)
+	// The informer may not have seen a drain started moments ago, possibly by another replica. Read the pod from the
+	// API server before starting a new drain, so the deadline is never pushed out.
+	if _, ok := wh.drains.Get(ctx, pod); !ok {
+		pod, err = wh.clientSet.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
 		if err != nil {
-			return false, fmt.Sprintf("Failed to marshal service name for pod %s/%s: %s", req.Namespace, req.Name, err), nil, nil
+			return false, fmt.Sprintf("Failed to read pod %s/%s: %v", namespace, name, err), time.Time{}
 		}
+	}
 
-		if c, ok := deletionCache[cacheID]; ok {
-			// TODO: delete the pod in timer
-			if time.Now().After(c) {
-				log.Printf("Pod %s passed pre-deletion-hook, allow deletion.", cacheID)
-
-				resp, err := http.DefaultClient.Post(fmt.Sprintf("http://%s:10257/reset", pod.Status.HostIP), "application/json", bytes.NewBuffer(reqBody))
-				if err != nil {
-					return false, fmt.Sprintf("Failed to reset endpoint %s/%s: %v", req.Namespace, req.Name, err), nil, nil
+	if state, ok := wh.drains.Get(ctx, pod); ok {
+		if wh.clock.Now().Before(state.Deadline) {
+			observed, probes := wh.drainObserved(ctx, pod, state)
+			if !observed {
+				reason := fmt.Sprintf("Pod %s requires pre-deletion-hook, will allow deletion at %s (delay %s from %s).", cacheID, state.Deadline, state.Delay, state.DelaySource)
+				if probes != "" {
+					reason = fmt.Sprintf("%s Load balancer probes: %s.", reason, probes)
 				}
-				if resp.StatusCode != http.StatusOK {
-					return false, fmt.Sprintf("Failed to reset endpoint %s/%s, status code: %d", req.Namespace, req.Name, resp.StatusCode), nil, nil
-				}
-				defer resp.Body.Close()
-
-				delete(deletionCache, cacheID)
-				return true, "", nil, nil
+				logger.Info("Pod is draining, deny removal", "deadline", state.Deadline, "probes", probes)
+				wh.recordDrainEvent(pod, nil, v1.EventTypeNormal, eventDrainWaiting, "Refused %s while draining, will allow at %s", trigger, state.Deadline)
+				return false, reason, state.Deadline
 			}
-		} else {
-			// TODO: fail if no other healthy pods on the same node (by getting node name and loop endpoint sets)
-			resp, err := http.DefaultClient.Post(fmt.Sprintf("http://%s:10257/fail", pod.Status.HostIP), "application/json", bytes.NewBuffer(reqBody))
+			logger.Info("Drain observed by load balancer probes before deadline", "deadline", state.Deadline, "probes", probes)
+		}
+
+		// Services another pod on the node is still draining stay failed, that drain resets them.
+		release, err := wh.drains.Releasable(ctx, cacheID, state.NodeName, state.Services)
+		if err != nil {
+			logger.Error(err, "Failed to read drains on node", "node", state.NodeName)
+			return false, fmt.Sprintf("Failed to reset endpoint %s/%s: %v", namespace, name, err), time.Time{}
+		}
+		logger.Info("Pod passed pre-deletion-hook, resetting health checks", "services", serviceNames(release), "held", len(state.Services)-len(release), "node", state.NodeName)
+		var addr string
+		if len(release) > 0 {
+			addr, err = wh.healthProxyAddress(ctx, state.NodeName, state.HostIP)
 			if err != nil {
-				return false, fmt.Sprintf("Failed to set pod to fail %s/%s: %v", req.Namespace, req.Name, err), nil, nil
+				logger.Error(err, "Failed to locate health-proxy", "node", state.NodeName)
+				wh.recordDrainEvent(pod, release, v1.EventTypeWarning, eventHealthProxyUnreachable, "Failed to reset health check on node %s: %v", state.NodeName, err)
+				return false, fmt.Sprintf("Failed to reset endpoint %s/%s: %v", namespace, name, err), time.Time{}
 			}
-			if resp.StatusCode != http.StatusOK {
-				return false, fmt.Sprintf("Failed to set pod to fail %s/%s, status code: %d", req.Namespace, req.Name, resp.StatusCode), nil, nil
+		}
+		for _, rr := range release {
+			if err := wh.healthProxy.ResetService(ctx, addr, rr); err != nil {
+				logger.Error(err, "Failed to reset health check", "service", rr.String(), "node", state.NodeName)
+				healthProxyFailures.WithLabelValues(rr.Namespace, rr.Name, "reset").Inc()
+				wh.recordDrainEvent(pod, []api.ServiceRef{rr}, v1.EventTypeWarning, eventHealthProxyUnreachable, "Failed to reset health check on node %s: %v", state.NodeName, err)
+				return false, fmt.Sprintf("Failed to reset endpoint %s/%s: %v", namespace, name, err), time.Time{}
 			}
-			defer resp.Body.Close()
+		}
 
-			delayDuration := defaultDelay
-			if val, ok := pod.Annotations[podTerminationDelayAnnotation]; ok {
-				if sec, success := strconv.Atoi(val); success != nil {
-					delayDuration = time.Second * time.Duration(sec)
-				}
+		if err := wh.drains.Remove(ctx, namespace, name); err != nil {
+			logger.Error(err, "Failed to clear drain state")
+		}
+
+		for _, rr := range state.Services {
+			drainDuration.WithLabelValues(rr.Namespace, rr.Name).Observe(wh.clock.Since(state.StartTime).Seconds())
+		}
+		wh.recordDrainEvent(pod, state.Services, v1.EventTypeNormal, eventDrainCompleted, "Drained from node %s after %s, allowing %s", state.NodeName, wh.clock.Since(state.StartTime).Round(time.Second), trigger)
+		return true, "Pod drained, allow deletion.", time.Time{}
+	}
+
+	ses, err := wh.findService(pod)
+	if err != nil {
+		return false, fmt.Sprintf("Failed to locate service for pod %s/%s: %s", namespace, name, err), time.Time{}
+	}
+	if len(ses) == 0 {
+		logger.V(2).Info("Pod backs no service with local traffic policy annotated for pod-terminator, allow deletion")
+		return true, "Pod backs no service drained by pod-terminator, allow deletion.", time.Time{}
+	}
+
+	// Failing the health check drains the whole node for a service, so only do it when no other pod on this node
+	// keeps serving the service.
+	// Peers that are draining themselves do not keep serving.
+	var draining map[string]*drainState
+	for _, se := range ses {
+		if len(se.LocalPeers) == 0 {
+			continue
+		}
+		if draining, err = wh.drains.NodeDrains(ctx, pod.Spec.NodeName, cacheID); err != nil {
+			return false, fmt.Sprintf("Failed to read drains on node %s: %s", pod.Spec.NodeName, err), time.Time{}
+		}
+		break
+	}
+
+	rrs := make([]api.ServiceRef, 0, len(ses))
+	skipped := make([]string, 0)
+	for _, se := range ses {
+		peers := make([]string, 0, len(se.LocalPeers))
+		for _, peer := range se.LocalPeers {
+			if _, ok := draining[peer]; !ok {
+				peers = append(peers, peer)
 			}
-			deletionCache[cacheID] = time.Now().UTC().Add(delayDuration)
 		}
+
+		if len(peers) > 0 {
+			skipped = append(skipped, fmt.Sprintf("%s/%s (still served by %s)", se.Service.Namespace, se.Service.Name, strings.Join(peers, ", ")))
+			continue
+		}
+		rrs = append(rrs, se.Service)
+	}
+
+	if len(skipped) > 0 && len(rrs) == 0 {
+		reason := fmt.Sprintf("Pod %s is not the last ready endpoint on node %s for services %s, allow deletion without LB drain.", cacheID, pod.Spec.NodeName, strings.Join(skipped, "; "))
+		logger.Info("Pod is not the last ready endpoint on its node, allow deletion without LB drain", "node", pod.Spec.NodeName, "skipped", skipped)
+		return true, reason, time.Time{}
+	}
+
+	delay, delaySource, warnings := wh.effectiveDelay(ctx, pod, rrs)
+
+	addr, addrErr := wh.healthProxyAddress(ctx, pod.Spec.NodeName, pod.Status.HostIP)
+	if addrErr != nil && !currentConfig().AuditMode {
+		logger.Error(addrErr, "Failed to locate health-proxy", "node", pod.Spec.NodeName)
+		wh.recordDrainEvent(pod, rrs, v1.EventTypeWarning, eventHealthProxyUnreachable, "Cannot fail health check on node %s: %v", pod.Spec.NodeName, addrErr)
+		return false, fmt.Sprintf("Cannot drain pod %s: %s", cacheID, addrErr), time.Time{}
+	}
+	if addrErr != nil {
+		warnings = append(warnings, addrErr.Error())
 	}
 
-	reason := fmt.Sprintf("Pod %s requires pre-deletion-hook, will allow deletion at %s.", cacheID, deletionCache[cacheID])
-	log.Println(reason)
-	return false, reason, nil, nil
+	if currentConfig().AuditMode {
+		reason := fmt.Sprintf("Would fail health check of services %s on node %s and allow deletion after %s (delay from %s).", serviceNames(rrs), pod.Spec.NodeName, delay, delaySource)
+		if len(warnings) > 0 {
+			reason = fmt.Sprintf("%s Warnings: %s.", reason, strings.Join(warnings, "; "))
+		}
+		return false, reason, time.Time{}
+	}
+
+	now := wh.clock.Now().UTC()
+	// The drain is given up, also by the health-proxy, if the pod is still around long after the deadline.
+	outcomes, err := wh.failServices(ctx, pod, addr, rrs, delay+currentConfig().Drain.AbandonAfter.Duration)
+	if err != nil {
+		wh.recordDrainEvent(pod, nil, v1.EventTypeWarning, eventDrainAborted, "Drain aborted, %s: %s", err, outcomesString(outcomes))
+		return false, fmt.Sprintf("Failed to drain pod %s, %s: %s", cacheID, err, outcomesString(outcomes)), time.Time{}
+	}
+
+	state := &drainState{
+		StartTime:   now,
+		Deadline:    now.Add(delay),
+		Delay:       delay.String(),
+		DelaySource: delaySource,
+		Services:    rrs,
+		NodeName:    pod.Spec.NodeName,
+		HostIP:      pod.Status.HostIP,
+		Trigger:     trigger,
+	}
+	if err := wh.drains.Put(ctx, namespace, name, state); err != nil {
+		// Without a recorded deadline nothing would ever reset the services.
+		wh.rollbackServices(ctx, pod, addr, outcomes)
+		wh.recordDrainEvent(pod, nil, v1.EventTypeWarning, eventDrainAborted, "Drain aborted, failed to record drain state: %v", err)
+		return false, fmt.Sprintf("Failed to record drain state for pod %s: %s: %s", cacheID, err, outcomesString(outcomes)), time.Time{}
+	}
+
+	wh.recordDrainEvent(pod, rrs, v1.EventTypeNormal, eventDrainStarted, "Failed health check of services %s on node %s, will allow %s at %s", serviceNames(rrs), state.NodeName, trigger, state.Deadline)
+
+	reason := fmt.Sprintf("Pod %s requires pre-deletion-hook, will allow deletion at %s (delay %s from %s). Services: %s.", cacheID, state.Deadline, state.Delay, state.DelaySource, outcomesString(outcomes))
+	if len(warnings) > 0 {
+		reason = fmt.Sprintf("%s Warnings: %s.", reason, strings.Join(warnings, "; "))
+	}
+	if len(skipped) > 0 {
+		reason = fmt.Sprintf("%s Skipped LB drain for services still served on node %s: %s.", reason, pod.Spec.NodeName, strings.Join(skipped, "; "))
+	}
+	logger.Info("Started drain, deny removal", "services", serviceNames(rrs), "node", state.NodeName, "deadline", state.Deadline, "delay", state.Delay, "delaySource", state.DelaySource, "warnings", warnings, "skipped", skipped)
+	return false, reason, state.Deadline
+}
+
+// serviceEndpoint is a service backed by the pod, with the pod's endpoint conditions and the other ready pods of that
+// service running on the same node.
+type serviceEndpoint struct {
+	Service     api.ServiceRef
+	NodeName    string
+	Serving     bool
+	Terminating bool
+	LocalPeers  []string
 }
 
-func findService(clientSet *kubernetes.Clientset, namespace, name, podIP string) ([]ResourceIDRequest, error) {
-	eps, err := clientSet.CoreV1().Endpoints(namespace).List(context.Background(), metav1.ListOptions{})
+// findService discovers the services backed by the pod through their EndpointSlices, matching endpoints on the pod UID.
+// Only services the health-proxy drains are returned, see drainableService.
+func (wh *webhook) findService(pod *v1.Pod) ([]serviceEndpoint, error) {
+	selector, err := labels.Parse(discoveryv1.LabelServiceName)
 	if err != nil {
-		log.Printf("Failed to list endpoints: %s", err)
-		return []ResourceIDRequest{}, fmt.Errorf("failed to list endpoints: %s", err)
+		return []serviceEndpoint{}, err
 	}
 
-	rr := make([]ResourceIDRequest, 0)
-	for _, ep := range eps.Items {
-		for _, ss := range ep.Subsets {
-			for _, addr := range ss.Addresses {
-				if addr.IP == podIP {
-					nsn := ResourceIDRequest{
-						Namespace: ep.Namespace,
-						Name:      ep.Name,
-					}
+	slices, err := wh.cluster.endpointSlices.EndpointSlices(pod.Namespace).List(selector)
+	if err != nil {
+		return []serviceEndpoint{}, fmt.Errorf("failed to list endpoint slices: %s", err)
+	}
 
-					rr = append(rr, nsn)
-				}
-			}
+	// A service may be split over several slices, so collect per service first.
+	found := map[string]*serviceEndpoint{}
+	peers := map[string]sets.String{}
+	for _, slice := range slices {
+		svcName := slice.Labels[discoveryv1.LabelServiceName]
+		if svcName == "" {
+			continue
+		}
+
+		svc, err := wh.cluster.services.Services(pod.Namespace).Get(svcName)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return []serviceEndpoint{}, fmt.Errorf("failed to read service %s/%s: %s", pod.Namespace, svcName, err)
+		}
+		if !drainableService(svc) {
+			continue
+		}
+
+		if _, ok := peers[svcName]; !ok {
+			peers[svcName] = sets.NewString()
+		}
 
-			for _, addr := range ss.NotReadyAddresses {
-				if addr.IP == podIP {
-					nsn := ResourceIDRequest{
-						Namespace: ep.Namespace,
-						Name:      ep.Name,
-					}
+		for _, ep := range slice.Endpoints {
+			if ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" {
+				continue
+			}
 
-					rr = append(rr, nsn)
+			if ep.TargetRef.UID == pod.UID {
+				se := &serviceEndpoint{
+					Service: api.ServiceRef{
+						Namespace: slice.Namespace,
+						Name:      svcName,
+					},
+					Serving:     isServing(ep.Conditions),
+					Terminating: isTerminating(ep.Conditions),
+				}
+				if ep.NodeName != nil {
+					se.NodeName = *ep.NodeName
 				}
+				found[svcName] = se
+				continue
+			}
+
+			if ep.NodeName != nil && *ep.NodeName == pod.Spec.NodeName && isReady(ep.Conditions) && !isTerminating(ep.Conditions) {
+				peers[svcName].Insert(podCacheID(ep.TargetRef.Namespace, ep.TargetRef.Name))
 			}
 		}
 	}
 
-	return rr, nil
+	ses := make([]serviceEndpoint, 0, len(found))
+	for svcName, se := range found {
+		se.LocalPeers = peers[svcName].List()
+		ses = append(ses, *se)
+	}
+	sort.Slice(ses, func(i, j int) bool { return ses[i].Service.Name < ses[j].Service.Name })
+
+	return ses, nil
 }
 
-func kubeClientSet(inCluster bool) (*kubernetes.Clientset, error) {
-	var config *rest.Config
+// isReady follows the EndpointSlice API convention that a nil condition is interpreted as ready.
+func isReady(c discoveryv1.EndpointConditions) bool {
+	return c.Ready == nil || *c.Ready
+}
 
-	if inCluster {
-		c, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
-		config = c
+func isServing(c discoveryv1.EndpointConditions) bool {
+	if c.Serving == nil {
+		return isReady(c)
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
+	return *c.Serving
+}
+
+func isTerminating(c discoveryv1.EndpointConditions) bool {
+	return c.Terminating != nil && *c.Terminating
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
 	}
+	return defaultValue
+}
 
-	return clientset, nil
+func createRecorder(kubeClient kubernetes.Interface, userAgent string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartStructuredLogging(0)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: userAgent})
 }
 
 func main() {
-	certPath := filepath.Join(tlsDir, tlsCertFile)
-	keyPath := filepath.Join(tlsDir, tlsKeyFile)
+	klog.InitFlags(nil)
+	reapInterval := flag.Duration("reap-interval", 10*time.Second, "How often to look for pods whose drain deadline has passed.")
+	drainSyncInterval := flag.Duration("drain-sync-interval", 30*time.Second, "How often every replica reloads the drain state of all pods, to pick up drains started or finished by other replicas.")
+	leaderElectionNamespace := flag.String("leader-election-namespace", envOrDefault("POD_NAMESPACE", "pod-terminator"), "Namespace of the lease used to elect the replica that reaps drained pods.")
+	configPath := flag.String("config", "", "Path to the webhook configuration file. Defaults apply when not set.")
+	configReloadInterval := flag.Duration("config-reload-interval", 10*time.Second, "How often to check the configuration file for changes.")
+	metricsAddr := flag.String("metrics-addr", ":9090", "Plain HTTP address to serve Prometheus metrics on.")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", 10*time.Second, "How often to check the TLS key pair for rotation.")
+	cacheResync := flag.Duration("cache-resync", 10*time.Minute, "Resync period of the informer caches.")
+	manageCerts := flag.Bool("manage-certs", false, "Bootstrap a CA and serving certificate in a Secret and inject the CA bundle into the webhook configurations, instead of reading the key pair from the TLS directory.")
+	certSecret := flag.String("cert-secret", "webhook-certificate", "Name of the Secret holding the managed certificates, in the webhook's namespace.")
+	serviceName := flag.String("service-name", "webhook-server", "Name of the webhook Service the managed serving certificate is issued for.")
+	healthProxyTokenFile := flag.String("health-proxy-token-file", "/var/run/secrets/pod-terminator/token", "Token sent to the health-proxy, projected with the audience the health-proxy accepts. Never the default ServiceAccount token, which the API server accepts too.")
+	healthProxyCAFile := flag.String("health-proxy-ca-file", "", "CA certificates to verify the health-proxy with. Without it the health-proxy is called over plain HTTP.")
+	healthProxyServerName := flag.String("health-proxy-server-name", "health-proxy.pod-terminator.svc", "Name the health-proxy certificate is verified for.")
+	certRotateBefore := flag.Duration("cert-rotate-before", 30*24*time.Hour, "How long before expiry a managed certificate is renewed.")
+	kubeOptions := &kubeclient.Options{}
+	kubeOptions.AddFlags(flag.CommandLine)
+	flag.Parse()
+	logging.Setup(os.Stderr)
 
-	clientSet, err := kubeClientSet(true)
+	clientSet, err := kubeOptions.ClientSet()
 	if err != nil {
-		log.Fatal(err)
+		klog.Fatal(err)
+	}
+
+	if *configPath != "" {
+		watcher := newConfigWatcher(*configPath, *configReloadInterval, func(old, new *webhookConfig) {
+			if !policyChanged(old, new) {
+				return
+			}
+			if err := registerSelectors(context.Background(), clientSet, &new.Policy); err != nil {
+				klog.ErrorS(err, "Failed to register policy selectors, the webhook filters requests itself")
+			}
+		})
+		if err := watcher.Load(); err != nil {
+			klog.Fatal(err)
+		}
+		go watcher.Run(wait.NeverStop)
+	}
+
+	cfg := currentConfig()
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if *manageCerts {
+		namespace := envOrDefault("POD_NAMESPACE", "pod-terminator")
+		certs := newCertManager(clientSet, namespace, *certSecret, *serviceName, *certRotateBefore, time.Hour)
+		if err := certs.Bootstrap(wait.NeverStop); err != nil {
+			klog.Fatal(err)
+		}
+		go certs.Run(wait.NeverStop)
+		getCertificate = certs.GetCertificate
+	} else {
+		certPath := filepath.Join(cfg.TLSDir, tlsCertFile)
+		keyPath := filepath.Join(cfg.TLSDir, tlsKeyFile)
+
+		certs, err := certwatcher.New(certPath, keyPath, *tlsReloadInterval)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		go certs.Run(wait.NeverStop)
+		getCertificate = certs.GetCertificate
 	}
 
+	if err := registerSelectors(context.Background(), clientSet, &cfg.Policy); err != nil {
+		klog.ErrorS(err, "Failed to register policy selectors, the webhook filters requests itself")
+	}
+
+	drains := newDrainCache(newAnnotationDrainStore(clientSet))
+	if err := drains.Sync(context.Background()); err != nil {
+		klog.Fatalf("Failed to rebuild drain state: %s", err)
+	}
+	go drains.Run(*drainSyncInterval, wait.NeverStop)
+
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	identity = envOrDefault("POD_NAME", identity)
+
+	registerMetrics(drains)
+	go func() {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		klog.Fatal(http.ListenAndServe(*metricsAddr, metricsMux))
+	}()
+
+	cluster := newClusterCache(clientSet, *cacheResync)
+	cluster.Start(wait.NeverStop)
+
+	if cfg.AuditMode {
+		klog.InfoS("Running in audit mode, pod removals are never denied")
+	}
+
+	wh := &webhook{
+		clientSet:   clientSet,
+		cluster:     cluster,
+		drains:      drains,
+		recorder:    createRecorder(clientSet, "pod-terminator"),
+		healthProxy: api.NewClient(*healthProxyTokenFile, *healthProxyCAFile, *healthProxyServerName),
+		clock:       clock.RealClock{},
+	}
+	reaper := newReaper(wh, *reapInterval)
+	go runLeaderElection(context.Background(), clientSet, *leaderElectionNamespace, identity, reaper.Run)
+
 	mux := http.NewServeMux()
-	mux.Handle("/validate", admitFuncHandler(validateDeletion, clientSet))
+	mux.Handle("/validate", wh.admitFuncHandler(wh.validateDeletion))
+	mux.Handle("/mutate", wh.admitFuncHandler(wh.mutatePod))
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, req *http.Request) {
+		if !cluster.Ready() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
 	server := &http.Server{
-		Addr:    ":8443",
+		Addr:    cfg.ListenAddress,
 		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: getCertificate,
+		},
 	}
-	log.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+	klog.Fatal(server.ListenAndServeTLS("", ""))
 }
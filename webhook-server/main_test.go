@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testNamespace = "default"
+	testPod       = "web-1"
+	testPeer      = "web-2"
+	testNode      = "node-1"
+)
+
+// fakeHealthProxy keeps the failed services of one node, and fails FailService for the services in failErrs.
+type fakeHealthProxy struct {
+	lock     sync.Mutex
+	failed   map[api.ServiceRef]bool
+	failErrs map[api.ServiceRef]error
+	resets   []api.ServiceRef
+}
+
+func (f *fakeHealthProxy) FailService(ctx context.Context, addr string, ref api.ServiceRef, ttl time.Duration) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failErrs[ref]; err != nil {
+		return err
+	}
+	f.failed[ref] = true
+	return nil
+}
+
+func (f *fakeHealthProxy) ResetService(ctx context.Context, addr string, ref api.ServiceRef) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.failed, ref)
+	f.resets = append(f.resets, ref)
+	return nil
+}
+
+func (f *fakeHealthProxy) ServiceStatus(ctx context.Context, addr string, ref api.ServiceRef) (*api.ServiceStatus, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return &api.ServiceStatus{Terminating: f.failed[ref]}, nil
+}
+
+func (f *fakeHealthProxy) failedServices() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	names := make([]string, 0, len(f.failed))
+	for ref := range f.failed {
+		names = append(names, ref.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testService(name string, trafficPolicy v1.ServiceExternalTrafficPolicyType) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        name,
+			Annotations: map[string]string{"pod-terminator": "enabled"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: trafficPolicy,
+			Selector:              map[string]string{"app": "web"},
+		},
+	}
+}
+
+func testEndpointSlice(service string, pods ...*v1.Pod) *discoveryv1.EndpointSlice {
+	ready := true
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testNamespace,
+			Name:      service + "-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for _, pod := range pods {
+		nodeName := pod.Spec.NodeName
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{pod.Status.PodIP},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			NodeName:   &nodeName,
+			TargetRef:  &v1.ObjectReference{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID},
+		})
+	}
+	return slice
+}
+
+func testBackendPod(name, podIP string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   testNamespace,
+			Name:        name,
+			UID:         types.UID("uid-" + name),
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"pod-terminator": "enabled"},
+		},
+		Spec:   v1.PodSpec{NodeName: testNode},
+		Status: v1.PodStatus{HostIP: "192.168.0.1", PodIP: podIP},
+	}
+}
+
+// testObjects returns the pod under test backing the services on testNode, and its health-proxy. With peerDrain, a
+// second pod on testNode backs the services in peerDrain and is already draining them, as if started by another
+// replica.
+func testObjects(t *testing.T, services []*v1.Service, peerDrain []api.ServiceRef) []runtime.Object {
+	t.Helper()
+	pod := testBackendPod(testPod, "10.0.0.5")
+	healthProxy := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "pod-terminator",
+			Name:      "health-proxy-xyz",
+			Labels:    map[string]string{"app": "health-proxy"},
+		},
+		Spec: v1.PodSpec{
+			NodeName: testNode,
+			Containers: []v1.Container{{
+				Name:  "proxy",
+				Ports: []v1.ContainerPort{{Name: "control", ContainerPort: 10257}},
+			}},
+		},
+		Status: v1.PodStatus{
+			PodIP:      "192.168.0.1",
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+
+	objects := []runtime.Object{
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}},
+		pod,
+		healthProxy,
+	}
+
+	var peer *v1.Pod
+	if len(peerDrain) > 0 {
+		peer = testBackendPod(testPeer, "10.0.0.6")
+		raw, err := json.Marshal(&drainState{
+			StartTime: time.Date(2021, 5, 1, 11, 59, 0, 0, time.UTC),
+			Deadline:  time.Date(2021, 5, 1, 13, 0, 0, 0, time.UTC),
+			Services:  peerDrain,
+			NodeName:  testNode,
+			HostIP:    peer.Status.HostIP,
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal drain state: %s", err)
+		}
+		peer.Labels[podDrainingLabel] = "true"
+		peer.Annotations[podDrainStateAnnotation] = string(raw)
+		objects = append(objects, peer)
+	}
+
+	for _, svc := range services {
+		backends := []*v1.Pod{pod}
+		for _, rr := range peerDrain {
+			if rr.Name == svc.Name {
+				backends = append(backends, peer)
+			}
+		}
+		objects = append(objects, svc, testEndpointSlice(svc.Name, backends...))
+	}
+	return objects
+}
+
+func newTestWebhook(t *testing.T, hp *fakeHealthProxy, objects []runtime.Object) (*webhook, *clock.FakeClock) {
+	t.Helper()
+	activeConfig.Store(defaultConfig())
+
+	clientSet := fake.NewSimpleClientset(objects...)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	cluster := newClusterCache(clientSet, 0)
+	cluster.Start(stopCh)
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) { return cluster.Ready(), nil }); err != nil {
+		t.Fatalf("caches did not sync: %s", err)
+	}
+
+	fakeClock := clock.NewFakeClock(time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC))
+	return &webhook{
+		clientSet:   clientSet,
+		cluster:     cluster,
+		drains:      newDrainCache(newAnnotationDrainStore(clientSet)),
+		recorder:    record.NewFakeRecorder(1000),
+		healthProxy: hp,
+		clock:       fakeClock,
+	}, fakeClock
+}
+
+func removalRequest(eviction bool) *admissionv1.AdmissionRequest {
+	req := &admissionv1.AdmissionRequest{
+		UID:       types.UID("uid-request"),
+		Resource:  podResource,
+		Namespace: testNamespace,
+		Name:      testPod,
+		Operation: admissionv1.Delete,
+	}
+	if eviction {
+		req.SubResource = evictionSubResource
+		req.Operation = admissionv1.Create
+	}
+	return req
+}
+
+// removalStep is one delete or eviction request of a pod, sent after advancing the clock.
+type removalStep struct {
+	advance  time.Duration
+	eviction bool
+
+	allowed bool
+	// retryAfter is the Retry-After expected on a 429 response, zero if no 429 is expected.
+	retryAfter int32
+	// failed are the services failed on the health-proxy after the step.
+	failed []string
+}
+
+func TestRemovalFlow(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*v1.Service
+		// peerDrain are the services a second pod on the node is draining, and which are failed on the health-proxy.
+		peerDrain []api.ServiceRef
+		failErrs  map[api.ServiceRef]error
+		steps     []removalStep
+		// resets are the services reset on the health-proxy during the flow, in order.
+		resets []string
+	}{
+		{
+			name:     "delete fails the service, waits, then resets and allows",
+			services: []*v1.Service{testService("web", v1.ServiceExternalTrafficPolicyTypeLocal)},
+			steps: []removalStep{
+				{allowed: false, failed: []string{"default/web"}},
+				{advance: time.Minute, allowed: false, failed: []string{"default/web"}},
+				{advance: 91 * time.Second, allowed: true, failed: []string{}},
+			},
+			resets: []string{"default/web"},
+		},
+		{
+			name:     "eviction gets 429 with Retry-After until the deadline",
+			services: []*v1.Service{testService("web", v1.ServiceExternalTrafficPolicyTypeLocal)},
+			steps: []removalStep{
+				{eviction: true, retryAfter: 150, failed: []string{"default/web"}},
+				{advance: 50 * time.Second, eviction: true, retryAfter: 100, failed: []string{"default/web"}},
+				{advance: 101 * time.Second, eviction: true, allowed: true, failed: []string{}},
+			},
+			resets: []string{"default/web"},
+		},
+		{
+			name: "partial failure rolls back the failed services",
+			services: []*v1.Service{
+				testService("api", v1.ServiceExternalTrafficPolicyTypeLocal),
+				testService("web", v1.ServiceExternalTrafficPolicyTypeLocal),
+			},
+			failErrs: map[api.ServiceRef]error{
+				{Namespace: testNamespace, Name: "api"}: fmt.Errorf("health-proxy unavailable"),
+			},
+			steps: []removalStep{
+				{allowed: false, failed: []string{}},
+			},
+			resets: []string{"default/web"},
+		},
+		{
+			name: "partial failure leaves services held by another drain failed",
+			services: []*v1.Service{
+				testService("api", v1.ServiceExternalTrafficPolicyTypeLocal),
+				testService("web", v1.ServiceExternalTrafficPolicyTypeLocal),
+			},
+			peerDrain: []api.ServiceRef{{Namespace: testNamespace, Name: "web"}},
+			failErrs: map[api.ServiceRef]error{
+				{Namespace: testNamespace, Name: "api"}: fmt.Errorf("health-proxy unavailable"),
+			},
+			steps: []removalStep{
+				{allowed: false, failed: []string{"default/web"}},
+			},
+			resets: []string{},
+		},
+		{
+			name:      "service held by a drain of another replica stays failed",
+			services:  []*v1.Service{testService("web", v1.ServiceExternalTrafficPolicyTypeLocal)},
+			peerDrain: []api.ServiceRef{{Namespace: testNamespace, Name: "web"}},
+			steps: []removalStep{
+				{allowed: false, failed: []string{"default/web"}},
+				{advance: 151 * time.Second, allowed: true, failed: []string{"default/web"}},
+			},
+			resets: []string{},
+		},
+		{
+			name:     "pod without a drained service is allowed right away",
+			services: []*v1.Service{testService("web", v1.ServiceExternalTrafficPolicyTypeCluster)},
+			steps: []removalStep{
+				{allowed: true, failed: []string{}},
+			},
+			resets: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hp := &fakeHealthProxy{failed: map[api.ServiceRef]bool{}, failErrs: tc.failErrs}
+			for _, rr := range tc.peerDrain {
+				hp.failed[rr] = true
+			}
+			wh, fakeClock := newTestWebhook(t, hp, testObjects(t, tc.services, tc.peerDrain))
+
+			for i, step := range tc.steps {
+				fakeClock.Step(step.advance)
+				allowed, reason, _, err := wh.validateDeletion(context.Background(), removalRequest(step.eviction))
+
+				if step.retryAfter > 0 {
+					if !apierrors.IsTooManyRequests(err) {
+						t.Fatalf("step %d: expected 429, got allowed=%v err=%v reason=%q", i, allowed, err, reason)
+					}
+					if got := err.(apierrors.APIStatus).Status().Details.RetryAfterSeconds; got != step.retryAfter {
+						t.Errorf("step %d: expected Retry-After %d, got %d", i, step.retryAfter, got)
+					}
+				} else if err != nil {
+					t.Fatalf("step %d: unexpected error: %s", i, err)
+				} else if allowed != step.allowed {
+					t.Fatalf("step %d: expected allowed=%v, got %v: %s", i, step.allowed, allowed, reason)
+				}
+
+				if got := hp.failedServices(); fmt.Sprint(got) != fmt.Sprint(step.failed) {
+					t.Errorf("step %d: expected failed services %v, got %v", i, step.failed, got)
+				}
+			}
+
+			resets := make([]string, 0, len(hp.resets))
+			for _, ref := range hp.resets {
+				resets = append(resets, ref.String())
+			}
+			if fmt.Sprint(resets) != fmt.Sprint(tc.resets) {
+				t.Errorf("expected resets %v, got %v", tc.resets, resets)
+			}
+			if state, ok := wh.drains.List()[podCacheID(testNamespace, testPod)]; ok {
+				t.Errorf("expected no drain state left, got %v", state)
+			}
+		})
+	}
+}
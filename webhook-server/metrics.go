@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+)
+
+const (
+	decisionAllowed        = "allowed"
+	decisionDeniedDraining = "denied-draining"
+	decisionError          = "error"
+)
+
+var (
+	admissionDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pod_terminator",
+		Name:      "admission_decisions_total",
+		Help:      "Number of pod removal admission decisions by outcome.",
+	}, []string{"namespace", "decision"})
+
+	admissionLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pod_terminator",
+		Name:      "admission_duration_seconds",
+		Help:      "Time taken to review a pod removal.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"namespace"})
+
+	drainDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pod_terminator",
+		Name:      "drain_duration_seconds",
+		Help:      "Time from failing a service's health check until the pod removal was allowed.",
+		Buckets:   []float64{15, 30, 60, 90, 120, 150, 180, 240, 300, 600, 1200},
+	}, []string{"namespace", "service"})
+
+	healthProxyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pod_terminator",
+		Name:      "health_proxy_failures_total",
+		Help:      "Number of failed calls to the health-proxy.",
+	}, []string{"namespace", "service", "action"})
+
+	pendingDrainsDesc = prometheus.NewDesc(
+		"pod_terminator_pending_drains",
+		"Number of pods currently draining.",
+		[]string{"namespace", "service"}, nil)
+)
+
+// pendingDrainsCollector reports the pending drains from the drain cache at scrape time, so the gauge always agrees
+// with the drain state.
+type pendingDrainsCollector struct {
+	drains *drainCache
+}
+
+var _ prometheus.Collector = pendingDrainsCollector{}
+
+func (c pendingDrainsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingDrainsDesc
+}
+
+func (c pendingDrainsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[api.ServiceRef]int{}
+	for _, state := range c.drains.List() {
+		for _, rr := range state.Services {
+			counts[rr]++
+		}
+	}
+
+	for rr, count := range counts {
+		ch <- prometheus.MustNewConstMetric(pendingDrainsDesc, prometheus.GaugeValue, float64(count), rr.Namespace, rr.Name)
+	}
+}
+
+func registerMetrics(drains *drainCache) {
+	prometheus.MustRegister(
+		admissionDecisions,
+		admissionLatency,
+		drainDuration,
+		healthProxyFailures,
+		pendingDrainsCollector{drains: drains},
+	)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const podTerminatorEnabled = "enabled"
+
+// mutatePod opts new pods into pod-terminator when they back a Service that is annotated for it, and extends their
+// terminationGracePeriodSeconds to fit the drain delay.
+func (wh *webhook) mutatePod(ctx context.Context, req *admissionv1.AdmissionRequest) (bool, string, []patchOperation, error) {
+	if req.Resource != podResource || req.SubResource != "" || req.Operation != admissionv1.Create {
+		return true, "", nil, nil
+	}
+
+	logger := logging.FromContext(ctx)
+	if !wh.cluster.Ready() {
+		logger.Info("Webhook caches are not synced yet, skip mutating pod")
+		return true, "", nil, nil
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return false, "", nil, fmt.Errorf("could not decode pod: %v", err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	cfg := currentConfig()
+	if !cfg.Policy.coversPod(pod) {
+		return true, "", nil, nil
+	}
+
+	services, err := wh.selectingServices(pod)
+	if err != nil {
+		logger.Error(err, "Failed to list services")
+		return true, "", nil, nil
+	}
+
+	patches := make([]patchOperation, 0)
+	if _, ok := pod.Annotations[cfg.Annotations.Enabled]; !ok {
+		if len(services) == 0 {
+			return true, "", nil, nil
+		}
+
+		if pod.Annotations == nil {
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/annotations",
+				Value: map[string]string{cfg.Annotations.Enabled: podTerminatorEnabled},
+			})
+		} else {
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/annotations/" + escapeJSONPointer(cfg.Annotations.Enabled),
+				Value: podTerminatorEnabled,
+			})
+		}
+		logger.Info("Opting pod into pod-terminator", "services", serviceNames(services))
+	} else if strings.EqualFold(pod.Annotations[cfg.Annotations.Enabled], "false") {
+		return true, "", nil, nil
+	}
+
+	delay, source, _ := wh.effectiveDelay(ctx, pod, services)
+	graceSeconds := int64(math.Ceil(delay.Seconds()))
+	grace := int64(v1.DefaultTerminationGracePeriodSeconds)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		grace = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	if grace < graceSeconds {
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/spec/terminationGracePeriodSeconds",
+			Value: graceSeconds,
+		})
+		logger.Info("Extending terminationGracePeriodSeconds to fit drain delay", "from", grace, "to", graceSeconds, "delaySource", source)
+	}
+
+	return true, "", patches, nil
+}
+
+// selectingServices returns the Services annotated for pod-terminator with local traffic policy whose selector
+// matches the pod.
+func (wh *webhook) selectingServices(pod *v1.Pod) ([]api.ServiceRef, error) {
+	svcs, err := wh.cluster.services.Services(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := make([]api.ServiceRef, 0)
+	for _, svc := range svcs {
+		if !drainableService(svc) {
+			continue
+		}
+
+		if len(svc.Spec.Selector) == 0 || !labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		rrs = append(rrs, api.ServiceRef{Namespace: svc.Namespace, Name: svc.Name})
+	}
+
+	return rrs, nil
+}
+
+// drainableService reports whether the health-proxy proxies the health check of the service: it must have local
+// traffic policy and be annotated for pod-terminator, the same as the health-proxy's --annotation filter.
+func drainableService(svc *v1.Service) bool {
+	return svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal &&
+		strings.EqualFold(svc.Annotations[currentConfig().Annotations.Enabled], podTerminatorEnabled)
+}
+
+// escapeJSONPointer escapes a key for use in a JSON pointer, see https://tools.ietf.org/html/rfc6901 .
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/yangl900/pod-terminator/logging"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// webhookConfigurationName is the name of the Validating- and MutatingWebhookConfiguration registering this webhook.
+const webhookConfigurationName = "pod-terminator"
+
+// selectionPolicy decides which namespaces and pods the webhook covers.
+type selectionPolicy struct {
+	// IncludeNamespaces limits the webhook to the listed namespaces. Empty means all namespaces.
+	IncludeNamespaces []string `json:"includeNamespaces,omitempty"`
+	// ExcludeNamespaces are never covered, even if included.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// NamespaceSelector must match the labels of a covered namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// ObjectSelector must match the labels of a covered pod.
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+
+	namespaceSelector labels.Selector
+	objectSelector    labels.Selector
+}
+
+// defaultSelectionPolicy leaves out the Kubernetes-owned namespaces.
+func defaultSelectionPolicy() *selectionPolicy {
+	p := &selectionPolicy{
+		ExcludeNamespaces: []string{metav1.NamespacePublic, metav1.NamespaceSystem},
+	}
+	if err := p.compile(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *selectionPolicy) compile() error {
+	var err error
+	if p.namespaceSelector, err = selectorOrEverything(p.NamespaceSelector); err != nil {
+		return fmt.Errorf("namespaceSelector: %s", err)
+	}
+	if p.objectSelector, err = selectorOrEverything(p.ObjectSelector); err != nil {
+		return fmt.Errorf("objectSelector: %s", err)
+	}
+	return nil
+}
+
+func selectorOrEverything(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// coversNamespace checks the namespace against the include and exclude lists and the namespace selector.
+func (p *selectionPolicy) coversNamespace(ctx context.Context, namespaces corelisters.NamespaceLister, ns string) bool {
+	if sets.NewString(p.ExcludeNamespaces...).Has(ns) {
+		return false
+	}
+
+	if len(p.IncludeNamespaces) > 0 && !sets.NewString(p.IncludeNamespaces...).Has(ns) {
+		return false
+	}
+
+	if p.namespaceSelector.Empty() {
+		return true
+	}
+
+	namespace, err := namespaces.Get(ns)
+	if err != nil {
+		logging.FromContext(ctx).Error(err, "Failed to read namespace", "namespace", ns)
+		return false
+	}
+	return p.namespaceSelector.Matches(labels.Set(namespace.Labels))
+}
+
+// coversPod checks the pod labels against the object selector.
+func (p *selectionPolicy) coversPod(pod *v1.Pod) bool {
+	return p.objectSelector.Matches(labels.Set(pod.Labels))
+}
+
+// podOptedIn reports whether the pod takes part in pod-terminator, either through its own annotation or through an
+// annotation on its namespace. A pod annotated with "false" is always left out.
+func (wh *webhook) podOptedIn(ctx context.Context, pod *v1.Pod) bool {
+	key := currentConfig().Annotations.Enabled
+	if val, ok := pod.Annotations[key]; ok {
+		return !strings.EqualFold(val, "false")
+	}
+
+	namespace, err := wh.cluster.namespaces.Get(pod.Namespace)
+	if err != nil {
+		logging.FromContext(ctx).Error(err, "Failed to read namespace", "namespace", pod.Namespace)
+		return false
+	}
+	return strings.EqualFold(namespace.Annotations[key], podTerminatorEnabled)
+}
+
+// registrationNamespaceSelector translates the namespace part of the policy into a webhook namespaceSelector.
+func (p *selectionPolicy) registrationNamespaceSelector() *metav1.LabelSelector {
+	selector := &metav1.LabelSelector{}
+	if p.NamespaceSelector != nil {
+		selector = p.NamespaceSelector.DeepCopy()
+	}
+
+	if len(p.ExcludeNamespaces) > 0 {
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      v1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   p.ExcludeNamespaces,
+		})
+	}
+
+	if len(p.IncludeNamespaces) > 0 {
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      v1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   p.IncludeNamespaces,
+		})
+	}
+
+	return selector
+}
+
+// registerSelectors applies the policy to the namespaceSelector and objectSelector of every webhook in the
+// pod-terminator webhook configurations, so the API server only calls the webhook for covered pods. The selectors are
+// replaced as a whole, since a merge patch would keep labels that were removed from the policy. Webhooks intercepting
+// evictions keep an empty objectSelector, see interceptsEvictions.
+func registerSelectors(ctx context.Context, clientSet kubernetes.Interface, p *selectionPolicy) error {
+	namespaceSelector := p.registrationNamespaceSelector()
+	objectSelector := &metav1.LabelSelector{}
+	if p.ObjectSelector != nil {
+		objectSelector = p.ObjectSelector
+	}
+
+	webhooks := clientSet.AdmissionregistrationV1()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		validating, err := webhooks.ValidatingWebhookConfigurations().Get(ctx, webhookConfigurationName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range validating.Webhooks {
+			validating.Webhooks[i].NamespaceSelector = namespaceSelector.DeepCopy()
+			validating.Webhooks[i].ObjectSelector = objectSelector.DeepCopy()
+			if interceptsEvictions(validating.Webhooks[i].Rules) {
+				validating.Webhooks[i].ObjectSelector = &metav1.LabelSelector{}
+			}
+		}
+		_, err = webhooks.ValidatingWebhookConfigurations().Update(ctx, validating, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update validating webhook configuration: %s", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		mutating, err := webhooks.MutatingWebhookConfigurations().Get(ctx, webhookConfigurationName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range mutating.Webhooks {
+			mutating.Webhooks[i].NamespaceSelector = namespaceSelector.DeepCopy()
+			mutating.Webhooks[i].ObjectSelector = objectSelector.DeepCopy()
+		}
+		_, err = webhooks.MutatingWebhookConfigurations().Update(ctx, mutating, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update mutating webhook configuration: %s", err)
+	}
+	return nil
+}
+
+// interceptsEvictions reports whether any of the rules matches the pods/eviction subresource. The API server matches
+// the objectSelector of such a webhook against the Eviction object, which has no labels, so any objectSelector would
+// keep evictions from reaching the webhook. Evictions are checked against the policy by coversPod instead.
+func interceptsEvictions(rules []admissionregistrationv1.RuleWithOperations) bool {
+	for _, rule := range rules {
+		for _, resource := range rule.Resources {
+			if resource == "*/*" || resource == "pods/*" || strings.HasSuffix(resource, "/eviction") {
+				return true
+			}
+		}
+	}
+	return false
+}
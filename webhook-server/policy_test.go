@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podRule(operation admissionregistrationv1.OperationType, resource string) admissionregistrationv1.RuleWithOperations {
+	return admissionregistrationv1.RuleWithOperations{
+		Operations: []admissionregistrationv1.OperationType{operation},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{resource},
+		},
+	}
+}
+
+func TestRegisterSelectors(t *testing.T) {
+	policy := &selectionPolicy{
+		ExcludeNamespaces: []string{metav1.NamespaceSystem},
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+		ObjectSelector:    &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "frontend"}},
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatalf("failed to compile policy: %s", err)
+	}
+
+	stale := &metav1.LabelSelector{MatchLabels: map[string]string{"stale": "true"}}
+	clientSet := fake.NewSimpleClientset(
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: webhookConfigurationName},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{
+					Name:           "webhook-server.pod-terminator.svc",
+					Rules:          []admissionregistrationv1.RuleWithOperations{podRule(admissionregistrationv1.Delete, "pods")},
+					ObjectSelector: stale,
+				},
+				{
+					Name:           "eviction.webhook-server.pod-terminator.svc",
+					Rules:          []admissionregistrationv1.RuleWithOperations{podRule(admissionregistrationv1.Create, "pods/eviction")},
+					ObjectSelector: stale,
+				},
+			},
+		},
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: webhookConfigurationName},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{
+					Name:  "webhook-server.pod-terminator.svc",
+					Rules: []admissionregistrationv1.RuleWithOperations{podRule(admissionregistrationv1.Create, "pods")},
+				},
+			},
+		},
+	)
+
+	if err := registerSelectors(context.Background(), clientSet, policy); err != nil {
+		t.Fatalf("failed to register selectors: %s", err)
+	}
+
+	namespaceSelector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{"team": "web"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{metav1.NamespaceSystem},
+		}},
+	}
+	expected := map[string]*metav1.LabelSelector{
+		"webhook-server.pod-terminator.svc":          policy.ObjectSelector,
+		"eviction.webhook-server.pod-terminator.svc": {},
+	}
+
+	validating, err := clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), webhookConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to read validating webhook configuration: %s", err)
+	}
+	for _, wh := range validating.Webhooks {
+		if !apiequality.Semantic.DeepEqual(wh.NamespaceSelector, namespaceSelector) {
+			t.Errorf("validating webhook %s: expected namespaceSelector %v, got %v", wh.Name, namespaceSelector, wh.NamespaceSelector)
+		}
+		if !apiequality.Semantic.DeepEqual(wh.ObjectSelector, expected[wh.Name]) {
+			t.Errorf("validating webhook %s: expected objectSelector %v, got %v", wh.Name, expected[wh.Name], wh.ObjectSelector)
+		}
+	}
+
+	mutating, err := clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), webhookConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to read mutating webhook configuration: %s", err)
+	}
+	for _, wh := range mutating.Webhooks {
+		if !apiequality.Semantic.DeepEqual(wh.NamespaceSelector, namespaceSelector) {
+			t.Errorf("mutating webhook %s: expected namespaceSelector %v, got %v", wh.Name, namespaceSelector, wh.NamespaceSelector)
+		}
+		if !apiequality.Semantic.DeepEqual(wh.ObjectSelector, policy.ObjectSelector) {
+			t.Errorf("mutating webhook %s: expected objectSelector %v, got %v", wh.Name, policy.ObjectSelector, wh.ObjectSelector)
+		}
+	}
+}
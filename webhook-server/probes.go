@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/yangl900/pod-terminator/health-proxy/api"
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+)
+
+// drainObserved reports whether the load balancer probes of every drained service have seen the failure often enough
+// to allow the pod deletion before the deadline. The returned message describes the probe counts per service.
+func (wh *webhook) drainObserved(ctx context.Context, pod *v1.Pod, state *drainState) (bool, string) {
+	thresholds := currentConfig().Drain
+	if !thresholds.probesEnabled() || len(state.Services) == 0 {
+		return false, ""
+	}
+
+	addr, err := wh.healthProxyAddress(ctx, state.NodeName, state.HostIP)
+	if err != nil {
+		logging.FromContext(ctx).Error(err, "Failed to locate health-proxy", "node", state.NodeName)
+		return false, err.Error()
+	}
+
+	observed := true
+	details := make([]string, 0, len(state.Services))
+	for _, rr := range state.Services {
+		status, err := wh.healthProxy.ServiceStatus(ctx, addr, rr)
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "Failed to read probe status", "service", rr.String(), "node", state.NodeName)
+			healthProxyFailures.WithLabelValues(rr.Namespace, rr.Name, "status").Inc()
+			wh.recordDrainEvent(pod, []api.ServiceRef{rr}, v1.EventTypeWarning, eventHealthProxyUnreachable, "Failed to read probe status on node %s: %v", state.NodeName, err)
+			details = append(details, fmt.Sprintf("%s/%s: %s", rr.Namespace, rr.Name, err))
+			observed = false
+			continue
+		}
+
+		details = append(details, fmt.Sprintf("%s/%s: %d failed probes from %d sources", rr.Namespace, rr.Name, status.FailedProbes, status.ProbeSources))
+		if !status.Terminating ||
+			status.FailedProbes < thresholds.FailedProbes ||
+			status.ProbeSources < thresholds.ProbeSources {
+			observed = false
+		}
+	}
+
+	return observed, strings.Join(details, "; ")
+}
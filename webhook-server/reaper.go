@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yangl900/pod-terminator/logging"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const leaseName = "pod-terminator-webhook"
+
+// reaper deletes or evicts pods whose drain deadline has passed, so that a drain completes even if nobody retries the
+// request. The request goes through the webhook again, which resets the health check and allows it.
+type reaper struct {
+	wh       *webhook
+	interval time.Duration
+}
+
+func newReaper(wh *webhook, interval time.Duration) *reaper {
+	return &reaper{
+		wh:       wh,
+		interval: interval,
+	}
+}
+
+// Run reaps expired drains every interval until the context is cancelled.
+func (r *reaper) Run(ctx context.Context) {
+	klog.InfoS("Starting reaper", "interval", r.interval)
+	wait.Until(r.reap, r.interval, ctx.Done())
+	klog.InfoS("Reaper stopped")
+}
+
+func (r *reaper) reap() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	logger := logging.FromContext(ctx).WithName("reaper")
+
+	// Other replicas may have started drains, pick them up from the store.
+	if err := r.wh.drains.Sync(ctx); err != nil {
+		logger.Error(err, "Failed to sync drain state")
+		return
+	}
+
+	now := r.wh.clock.Now()
+	abandonAfter := currentConfig().Drain.AbandonAfter.Duration
+	for cacheID, state := range r.wh.drains.Expired(now) {
+		parts := strings.SplitN(cacheID, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		namespace, name := parts[0], parts[1]
+		ref := &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name}
+		podCtx := logging.NewContext(ctx, logger.WithValues("pod", cacheID, "node", state.NodeName))
+		podLogger := logging.FromContext(podCtx)
+
+		if now.After(state.Deadline.Add(abandonAfter)) {
+			r.abandon(podCtx, ref, state)
+			continue
+		}
+
+		podLogger.Info("Drain passed deadline, removing pod", "deadline", state.Deadline, "trigger", state.Trigger)
+		err := r.remove(podCtx, namespace, name, state)
+		if errors.IsNotFound(err) {
+			podLogger.Info("Pod already deleted")
+			continue
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to delete pod after drain deadline %s: %s", state.Deadline, err)
+			podLogger.Error(err, "Failed to delete pod after drain deadline", "deadline", state.Deadline)
+			r.wh.recorder.Event(ref, v1.EventTypeWarning, "ReapFailed", msg)
+			continue
+		}
+
+		r.wh.recorder.Eventf(ref, v1.EventTypeNormal, "Reaped", "Deleted pod after drain deadline %s", state.Deadline)
+	}
+}
+
+// abandon gives up a drain whose pod could not be removed long after its deadline: it resets the health checks, which
+// the health-proxy also does once their TTL expires, and forgets the drain state.
+func (r *reaper) abandon(ctx context.Context, ref *v1.ObjectReference, state *drainState) {
+	cacheID := podCacheID(ref.Namespace, ref.Name)
+	logger := logging.FromContext(ctx)
+	logger.Info("Drain is abandoned", "deadline", state.Deadline, "abandonAfter", currentConfig().Drain.AbandonAfter.Duration)
+
+	// Without knowing which services other drains hold, leave them all to the health-proxy's TTL.
+	release, err := r.wh.drains.Releasable(ctx, cacheID, state.NodeName, state.Services)
+	if err != nil {
+		logger.Error(err, "Failed to read drains on node, the health-proxy resets the health checks when the TTL expires")
+	}
+
+	addr, addrErr := r.wh.healthProxyAddress(ctx, state.NodeName, state.HostIP)
+	for _, rr := range release {
+		err := addrErr
+		if err == nil {
+			err = r.wh.healthProxy.ResetService(ctx, addr, rr)
+		}
+		if err != nil {
+			healthProxyFailures.WithLabelValues(rr.Namespace, rr.Name, "reset").Inc()
+			logger.Error(err, "Failed to reset health check for abandoned drain, the health-proxy resets it when the TTL expires", "service", rr.String())
+		}
+	}
+
+	if err := r.wh.drains.Remove(ctx, ref.Namespace, ref.Name); err != nil {
+		logger.Error(err, "Failed to clear drain state")
+		return
+	}
+
+	msg := fmt.Sprintf("Abandoned drain from node %s, the pod was not removed by %s; reset health check of services %s", state.NodeName, state.Deadline, serviceNames(state.Services))
+	r.wh.recorder.Event(ref, v1.EventTypeWarning, eventDrainAbandoned, msg)
+	for _, rr := range state.Services {
+		svcRef := &v1.ObjectReference{Kind: "Service", APIVersion: "v1", Namespace: rr.Namespace, Name: rr.Name}
+		r.wh.recorder.Eventf(svcRef, v1.EventTypeWarning, eventDrainAbandoned, "Pod %s: %s", cacheID, msg)
+	}
+}
+
+// remove finishes the removal the way it was requested. Drains started by an eviction are finished by evicting
+// again, so that PodDisruptionBudgets are still respected.
+func (r *reaper) remove(ctx context.Context, namespace, name string, state *drainState) error {
+	if state.Trigger == triggerEviction {
+		return r.wh.clientSet.PolicyV1beta1().Evictions(namespace).Evict(ctx, &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		})
+	}
+
+	return r.wh.clientSet.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+// runLeaderElection runs the given function while holding the webhook lease, and campaigns again whenever the lease
+// is lost, until the context is cancelled.
+func runLeaderElection(ctx context.Context, clientSet kubernetes.Interface, namespace, identity string, run func(ctx context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      leaseName,
+		},
+		Client: clientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: run,
+				OnStoppedLeading: func() {
+					klog.InfoS("Stopped leading", "identity", identity)
+				},
+				OnNewLeader: func(leader string) {
+					klog.InfoS("New leader", "leader", leader)
+				},
+			},
+		})
+	}
+}